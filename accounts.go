@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// An Account is a named profile with its own crafter, since known recipes,
+// disciplines and materials all differ per account
+type Account struct {
+	Name    string
+	Crafter *Crafter
+}
+
+// FindProfitableOptionsByAccount runs FindProfitableOptions for every account and
+// merges the results per recipe, recommending the account that can cover the most
+// crafts from its material storage today (the first listed account wins ties)
+func FindProfitableOptionsByAccount(accounts []Account, itemID int, depth int) ([]AccountRecipeProfit, error) {
+	byRecipe := make(map[int]*AccountRecipeProfit)
+	var recipeOrder []int
+	for _, account := range accounts {
+		profitableRecipes, err := account.Crafter.FindProfitableOptions(itemID, depth)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find profitable options for account %s: %w", account.Name, err)
+		}
+		for _, recipeProfit := range profitableRecipes {
+			accountProfit, ok := byRecipe[recipeProfit.RecipeID]
+			if !ok {
+				accountProfit = &AccountRecipeProfit{RecipeProfit: recipeProfit, CraftsFromStorage: -1}
+				byRecipe[recipeProfit.RecipeID] = accountProfit
+				recipeOrder = append(recipeOrder, recipeProfit.RecipeID)
+			}
+			if len(accountProfit.Accounts) > 0 && accountProfit.Accounts[len(accountProfit.Accounts)-1] == account.Name {
+				// Recipes can be found through several paths at higher depths
+				continue
+			}
+			accountProfit.Accounts = append(accountProfit.Accounts, account.Name)
+
+			recipe, err := account.Crafter.localCache.GetRecipeById(recipeProfit.RecipeID)
+			if err != nil {
+				return nil, err
+			}
+			crafts, err := account.Crafter.craftsFromStorage(*recipe)
+			if err != nil {
+				logger.Warn("Cannot check material storage", "account", account.Name, "error", err)
+				crafts = 0
+			}
+			if recipeProfit.MaxCrafts >= 0 {
+				// Daily limited recipes are capped by what the account can still craft today
+				crafts = min(crafts, recipeProfit.MaxCrafts)
+			}
+			if crafts > accountProfit.CraftsFromStorage {
+				// Report daily crafting status from the recommended account's point of view
+				accountProfit.RecipeProfit = recipeProfit
+				accountProfit.CraftsFromStorage = crafts
+				accountProfit.RecommendedAccount = account.Name
+			}
+		}
+	}
+
+	combined := make([]AccountRecipeProfit, 0, len(recipeOrder))
+	for _, recipeID := range recipeOrder {
+		combined = append(combined, *byRecipe[recipeID])
+	}
+	sort.SliceStable(combined, func(i, j int) bool {
+		return combined[i].ProfitMargin > combined[j].ProfitMargin
+	})
+	return combined, nil
+}
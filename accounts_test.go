@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
+)
+
+func TestFindProfitableOptionsByAccount(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	db.SetMaxOpenConns(1)
+
+	recipes := []Recipe{
+		{ID: 1, Type: "Refinement", OutputItemID: 100, OutputItemCount: 1, Disciplines: StringSlice{"Armorsmith"}, MinRating: 400, Ingredients: []Ingredient{{ItemID: 10, Count: 2}}},
+		{ID: 2, Type: "Refinement", OutputItemID: 200, OutputItemCount: 1, Disciplines: StringSlice{"Chef"}, Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+	}
+	if err := updateRecipeCache(db, recipes); err != nil {
+		t.Fatalf("Failed to update recipe cache: %v", err)
+	}
+	if err := updateTradeableItemsCache(db, []int{10, 100, 200}); err != nil {
+		t.Fatalf("Failed to update tradeable items cache: %v", err)
+	}
+	localCache := NewLocalCache(db)
+
+	newAccount := func(name string, characters []Character, materials []MaterialStack) Account {
+		fake := fakeapi.New()
+		fake.SetAccountRecipes(1, 2)
+		err := fake.AddPrices(
+			ItemPrice{ID: 10, Buys: TradingPostPrice{UnitPrice: 100}},
+			ItemPrice{ID: 100, Sells: TradingPostPrice{UnitPrice: 400}},
+			ItemPrice{ID: 200, Sells: TradingPostPrice{UnitPrice: 300}},
+		)
+		if err != nil {
+			t.Fatalf("Failed to seed prices: %v", err)
+		}
+		for _, character := range characters {
+			if err := fake.SetCharacters(character); err != nil {
+				t.Fatalf("Failed to seed characters: %v", err)
+			}
+		}
+		for _, material := range materials {
+			if err := fake.SetMaterials(material); err != nil {
+				t.Fatalf("Failed to seed materials: %v", err)
+			}
+		}
+		server := httptest.NewServer(fake)
+		t.Cleanup(server.Close)
+		return Account{Name: name, Crafter: NewCrafter(*NewAPIClient(server.URL, name), *localCache)}
+	}
+
+	previousThreshold := configObj.ProfitThreshold
+	configObj.ProfitThreshold = 1.0
+	defer func() { configObj.ProfitThreshold = previousThreshold }()
+
+	accounts := []Account{
+		newAccount("cook", []Character{{Name: "Cook", Crafting: []CraftingDiscipline{{Discipline: "Chef", Rating: 500}}}}, nil),
+		newAccount("smith", []Character{{Name: "Smith", Crafting: []CraftingDiscipline{{Discipline: "Armorsmith", Rating: 400}, {Discipline: "Chef", Rating: 100}}}}, nil),
+		newAccount("hoarder", []Character{{Name: "Hoarder", Crafting: []CraftingDiscipline{{Discipline: "Armorsmith", Rating: 500}}}}, []MaterialStack{{ItemID: 10, Count: 7}}),
+	}
+
+	accountProfits, err := FindProfitableOptionsByAccount(accounts, 10, 1)
+	if err != nil {
+		t.Fatalf("FindProfitableOptionsByAccount() returned error: %v", err)
+	}
+	if len(accountProfits) != 2 {
+		t.Fatalf("FindProfitableOptionsByAccount() returned %+v, want 2 recipes", accountProfits)
+	}
+
+	// Recipe 2 has the highest margin and needs no rating, so every Chef can craft it
+	if got := accountProfits[0]; got.RecipeID != 2 || !reflect.DeepEqual(got.Accounts, []string{"cook", "smith"}) || got.RecommendedAccount != "cook" {
+		t.Errorf("First recipe = %+v, want recipe 2 for cook and smith, recommending cook", got)
+	}
+	// Recipe 1 requires Armorsmith 400; the hoarder can cover 3 crafts from storage
+	if got := accountProfits[1]; got.RecipeID != 1 || !reflect.DeepEqual(got.Accounts, []string{"smith", "hoarder"}) || got.RecommendedAccount != "hoarder" || got.CraftsFromStorage != 3 {
+		t.Errorf("Second recipe = %+v, want recipe 1 for smith and hoarder, recommending hoarder with 3 crafts", got)
+	}
+}
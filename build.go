@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const DefaultBuildCDNURL = "http://assetcdn.101.arenanetworks.com/latest/101"
+
+// A BuildSource provides the current game build number. Sources receive the
+// client so their requests share its transport (recording, replay, proxies).
+type BuildSource interface {
+	FetchBuildNumber(client *APIClient) (int, error)
+	Name() string
+}
+
+// CDNBuildSource reads the build number from the asset CDN manifest
+type CDNBuildSource struct {
+	URL string
+}
+
+func (source CDNBuildSource) Name() string {
+	return "cdn"
+}
+
+func (source CDNBuildSource) FetchBuildNumber(client *APIClient) (int, error) {
+	buildNumberData, err := fetchBuildNumberData(client.httpClient(), source.URL)
+	if err != nil {
+		return 0, err
+	}
+	return parseBuildNumber(buildNumberData)
+}
+
+// APIBuildSource reads the build number from the API's /build endpoint
+type APIBuildSource struct{}
+
+func (source APIBuildSource) Name() string {
+	return "api"
+}
+
+func (source APIBuildSource) FetchBuildNumber(client *APIClient) (int, error) {
+	var metadata Metadata
+	err := client.fetchAndDecode("/build", &metadata)
+	if err != nil {
+		return 0, err
+	}
+	if metadata.BuildNumber == 0 {
+		return 0, errors.New("API returned an empty build number")
+	}
+	return metadata.BuildNumber, nil
+}
+
+// PinnedBuildSource always returns a manually configured build number
+type PinnedBuildSource struct {
+	BuildNumber int
+}
+
+func (source PinnedBuildSource) Name() string {
+	return "pinned"
+}
+
+func (source PinnedBuildSource) FetchBuildNumber(client *APIClient) (int, error) {
+	if source.BuildNumber <= 0 {
+		return 0, errors.New("No pinned build number configured")
+	}
+	return source.BuildNumber, nil
+}
+
+// DefaultBuildSources tries the CDN manifest first, as /build can lag behind releases
+var DefaultBuildSources = []BuildSource{CDNBuildSource{URL: DefaultBuildCDNURL}, APIBuildSource{}}
+
+// fetchBuildNumberFromSources returns the build number from the first source that succeeds
+func fetchBuildNumberFromSources(client *APIClient, sources []BuildSource) (int, error) {
+	if len(sources) == 0 {
+		return 0, errors.New("No build number sources configured")
+	}
+	var failures []string
+	for _, source := range sources {
+		buildNumber, err := source.FetchBuildNumber(client)
+		if err == nil {
+			logger.Debug("Fetched build number", "source", source.Name(), "buildNumber", buildNumber)
+			return buildNumber, nil
+		}
+		logger.Warn("Build number source failed, trying next one", "source", source.Name(), "error", err)
+		failures = append(failures, fmt.Sprintf("%s: %v", source.Name(), err))
+	}
+	return 0, fmt.Errorf("All build number sources failed: %s", strings.Join(failures, "; "))
+}
+
+// NewBuildSources builds sources from their names ("cdn", "api" or "pinned") in fallback order
+func NewBuildSources(names []string, cdnURL string, pinnedBuild int) ([]BuildSource, error) {
+	if cdnURL == "" {
+		cdnURL = DefaultBuildCDNURL
+	}
+	var sources []BuildSource
+	for _, name := range names {
+		switch name {
+		case "cdn":
+			sources = append(sources, CDNBuildSource{URL: cdnURL})
+		case "api":
+			sources = append(sources, APIBuildSource{})
+		case "pinned":
+			sources = append(sources, PinnedBuildSource{BuildNumber: pinnedBuild})
+		default:
+			return nil, fmt.Errorf("Invalid build number source %s", name)
+		}
+	}
+	return sources, nil
+}
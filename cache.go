@@ -2,7 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -11,102 +16,74 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func UpdateCache(client *APIClient) {
-	db, err := sqlx.Connect("sqlite3", "cache.db")
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("Error updating local cache: %v", err))
-	}
-	defer db.Close()
+// merchantDataFile holds the hand-maintained merchant offerings
+const merchantDataFile = "merchant-data.json"
 
-	currentBuildMetadata, err := client.FetchBuildNumber()
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("Cannot fetch build number from API: %v", err))
+// InMemoryCache is the cache path that keeps the cache in memory for the
+// duration of a run, for experiments that should not touch the cache file
+const InMemoryCache = ":memory:"
+
+// cachePathEnv overrides the configured cache path
+const cachePathEnv = "GW2_CACHE_PATH"
+
+// ResolveCachePath picks the cache database path from the flag, the
+// environment, the config and finally the user cache directory, which follows
+// XDG_CACHE_HOME on Linux
+func ResolveCachePath(flagPath string, configPath string) (string, error) {
+	for _, path := range []string{flagPath, os.Getenv(cachePathEnv), configPath} {
+		if path != "" {
+			return path, nil
+		}
 	}
-	storedBuildNumber, err := fetchStoredBuildNumber(db)
+	cacheDir, err := os.UserCacheDir()
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("Cannot fetch stored build number from local cache: %v", err))
+		return "", fmt.Errorf("Failed to locate user cache directory, set a cache path instead: %w", err)
 	}
-	if currentBuildMetadata.BuildNumber > storedBuildNumber {
-		// update cache
-		logger.Info("Found new build, updating local cache...", "buildNumber", currentBuildMetadata.BuildNumber)
-		recipes, err := fetchAllRecipeDataFromAPI(client)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("%v", err))
-		}
-		err = updateRecipeCache(db, recipes)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Failure updating local recipe cache: %+v", err))
-		}
-		items, err := fetchAllItemDataFromAPI(client)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Failed to fetch item data from API: %v", err))
-		}
-		err = updateItemCache(db, items)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Failure updating local item cache: %v", err))
-		}
-		tradeableItemIds, err := client.FetchAllIds("/commerce/prices")
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Failed to fetch tradeable item ids from API: %v", err))
-		}
-		err = updateTradeableItemsCache(db, tradeableItemIds)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Failure updating local tradeable item cache: %v", err))
-		}
+	return filepath.Join(cacheDir, "gw2-mastercrafter", "cache.db"), nil
+}
 
-		currencies, err := client.FetchCurrencies()
-		if err != nil {
-			logger.Fatal("Failed to fetch currency info from API", "error", err)
-		}
-		err = updateCurrencyCache(db, currencies)
-		if err != nil {
-			logger.Fatal("Failure updating local currency info cache", "error", err)
-		}
-		merchants, err := ParseMerchantDataFile("merchant-data.json")
-		if err != nil {
-			logger.Fatal("Failure loading Merchant data from JSON file", "error", err)
-		}
-		err = updateMerchantOfferings(db, merchants)
-		if err != nil {
-			logger.Fatal("Failed to update local merchant cache", "error", err)
-		}
-		// update build number here
-		err = updateBuildMetadata(db, currentBuildMetadata)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Could not update Build metadata: %+v", err))
+// OpenCache opens the cache database at path, creating its directory when
+// needed, and migrates it to the current schema
+func OpenCache(path string) (*sqlx.DB, error) {
+	if path != InMemoryCache {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fmt.Errorf("Failed to create cache directory: %w", err)
 		}
 	}
+	db, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open local cache: %w", err)
+	}
+	if path == InMemoryCache {
+		// Every connection to :memory: is a separate database
+		db.SetMaxOpenConns(1)
+	}
+	if err := migrateCache(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to migrate local cache: %w", err)
+	}
+	if err := ensureItemSearchIndex(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
 }
 
-func LoadCache() []Recipe {
-	db, err := sqlx.Connect("sqlite3", "cache.db")
+func UpdateCache(client *APIClient, db *sqlx.DB, options CacheRefreshOptions) {
+	currentBuildMetadata, err := client.FetchBuildNumber()
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("Error updating cache: %v", err))
+		logger.Fatal(fmt.Sprintf("Cannot fetch build number from API: %v", err))
 	}
-	defer db.Close()
-
-	recipes, err := loadRecipeCache(db)
+	err = refreshCache(client, db, currentBuildMetadata, merchantDataFile, options)
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("Error loading recipe cache: %v\n", err))
+		logger.Fatal(fmt.Sprintf("Failure updating local cache, keeping the previous data: %v", err))
 	}
-
-	return recipes
 }
 
 func fetchStoredBuildNumber(db *sqlx.DB) (int, error) {
-	// Check if table already exists
-	var exists bool
-	err := db.Get(&exists, "SELECT EXISTS (SELECT name FROM sqlite_schema WHERE type='table' AND name='metadata')")
-	if err != nil {
-		return 0, fmt.Errorf("failed to check if table exists: %w", err)
-	}
-	if !exists {
-		// The table does not exist
-		return 0, nil
-	}
 	query := "SELECT build_number FROM metadata"
 	var currentBuildNumber int
-	err = db.QueryRow(query).Scan(&currentBuildNumber)
+	err := db.QueryRow(query).Scan(&currentBuildNumber)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			// The table is empty
@@ -117,273 +94,278 @@ func fetchStoredBuildNumber(db *sqlx.DB) (int, error) {
 	return currentBuildNumber, err
 }
 
-func fetchAllRecipeDataFromAPI(client *APIClient) ([]Recipe, error) {
-	logger.Debug("Fetching recipe data from API")
-	recipesIds, err := client.FetchAllRecipesIds()
-	if err != nil {
-		return []Recipe{}, err
-	}
-
-	recipeChannel := make(chan []Recipe)
-	recipeIdsChannel := make(chan RecipeIds)
-	errorChannel := make(chan error)
-	doneChannel := make(chan struct{})
+// streamBatchesFromAPI fetches the objects with the given IDs from a bulk
+// endpoint in concurrent batches, passing each object to yield as it is decoded.
+// yield is always called from the calling goroutine, so it may write to the
+// database without further locking. Objects arrive in no particular order, and
+// a batch that is retried may yield some objects twice.
+func streamBatchesFromAPI[T any](client *APIClient, endpoint string, ids []int, yield func(T) error) error {
+	logger.Debug(fmt.Sprintf("Found %d objects to fetch", len(ids)), "endpoint", endpoint)
 
 	concurrency := 8
 	batchSize := 200
 	ticker := time.NewTicker(time.Minute / 300) // GW2 API has 300 requests/minute rate limit
+	defer ticker.Stop()
+
+	objects := make(chan T, batchSize)
+	batches := make(chan []int)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var stopErr error
+	fail := func(err error) {
+		stopOnce.Do(func() {
+			stopErr = err
+			close(stop)
+		})
+	}
+	errStopped := errors.New("stopped")
+	send := func(object T) error {
+		select {
+		case objects <- object:
+			return nil
+		case <-stop:
+			return errStopped
+		}
+	}
 
 	// start goroutines
+	var wg sync.WaitGroup
 	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
 		go func() {
-			for recipeIdsBatch := range recipeIdsChannel {
-				var recipes []Recipe
-				var err error
+			defer wg.Done()
+			for batch := range batches {
+				batchEndpoint := fmt.Sprintf("%s?ids=%s", endpoint, formatIntSliceAsStr(batch))
 				retries := 3
 				delay := time.Second
-
-				for retries > 0 {
-					<-ticker.C
-					recipes, err = client.BatchFetchRecipes(recipeIdsBatch)
+				for {
+					select {
+					case <-ticker.C:
+					case <-stop:
+						return
+					}
+					err := streamArray(client, batchEndpoint, send)
 					if err == nil {
 						break
 					}
-					if isRetriable(err) {
+					if errors.Is(err, errStopped) {
+						return
+					}
+					retries--
+					if retries > 0 && isRetriable(err) {
+						client.metrics.recordRetry(endpoint)
 						time.Sleep(delay)
 						delay *= 2
-						retries--
 						continue
 					}
-				}
-				if err != nil {
-					errorChannel <- err
+					fail(err)
 					return
 				}
-				recipeChannel <- recipes
 			}
-			doneChannel <- struct{}{}
 		}()
 	}
 
 	// distribute work
 	go func() {
-		for i := 0; i < len(recipesIds); i += batchSize {
-			end := i + batchSize
-			if end > len(recipesIds) {
-				end = len(recipesIds)
+		defer close(batches)
+		for i := 0; i < len(ids); i += batchSize {
+			end := min(i+batchSize, len(ids))
+			select {
+			case batches <- ids[i:end]:
+			case <-stop:
+				return
 			}
-			recipeIdsChannel <- recipesIds[i:end]
 		}
-		close(recipeIdsChannel)
 	}()
 
-	recipes := []Recipe{}
-	completedGoroutines := 0
-	for completedGoroutines < concurrency {
-		select {
-		case recipesBatch := <-recipeChannel:
-			recipes = append(recipes, recipesBatch...)
-		case err := <-errorChannel:
-			return []Recipe{}, err
-		case <-doneChannel:
-			completedGoroutines++
+	go func() {
+		wg.Wait()
+		close(objects)
+	}()
+
+	for object := range objects {
+		if err := yield(object); err != nil {
+			fail(err)
+			// Drain so the workers notice the stop and exit
+			for range objects {
+			}
+			break
 		}
 	}
-	return recipes, nil
+	// Workers have exited once objects is closed, so stopErr is settled
+	return stopErr
 }
-func fetchAllItemDataFromAPI(client *APIClient) ([]Item, error) {
-	logger.Debug("Fetching Item data from API")
-	itemIds, err := client.FetchAllItemsIds()
-	if err != nil {
-		return []Item{}, err
-	}
 
-	logger.Debug(fmt.Sprintf("Found %d items to fetch", len(itemIds)))
+// refreshRecipeCache streams the given recipes from the API into the local cache
+func refreshRecipeCache(client *APIClient, db *sqlx.DB, recipeIds []int) error {
+	logger.Debug("Fetching recipe data from API", "size", len(recipeIds))
+	return writeRecipes(db, func(yield func(Recipe) error) error {
+		return streamBatchesFromAPI(client, "/recipes", recipeIds, yield)
+	})
+}
 
-	itemChannel := make(chan []Item)
-	itemIdsChannel := make(chan []int)
-	errorChannel := make(chan error)
-	doneChannel := make(chan struct{})
+// refreshItemCache streams the given items from the API into the local cache
+func refreshItemCache(client *APIClient, db *sqlx.DB, itemIds []int) error {
+	logger.Debug("Fetching Item data from API", "size", len(itemIds))
+	return writeItems(db, func(yield func(Item) error) error {
+		return streamBatchesFromAPI(client, "/items", itemIds, yield)
+	})
+}
 
-	concurrency := 8
-	batchSize := 200
-	ticker := time.NewTicker(time.Minute / 300) // GW2 API has 300 requests/minute rate limit
+func updateBuildMetadata(db sqlx.Execer, buildMetadata Metadata) error {
+	query := "UPDATE metadata set build_number = ?"
+	_, err := db.Exec(query, buildMetadata.BuildNumber)
+	return err
+}
 
-	// start goroutines
-	for i := 0; i < concurrency; i++ {
-		go func() {
-			for itemIdsBatch := range itemIdsChannel {
-				var items []Item
-				var err error
-				retries := 3
-				delay := time.Second
+func updateTradeableItemsCache(db *sqlx.DB, tradeableItemIds []int) error {
+	logger.Debug("Updating local tradeable items cache")
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
 
-				for retries > 0 {
-					<-ticker.C
-					items, err = client.BatchFetchItems(itemIdsBatch)
-					if err == nil {
-						break
-					}
-					if isRetriable(err) {
-						time.Sleep(delay)
-						delay *= 2
-						retries--
-						continue
-					}
-				}
-				if err != nil {
-					errorChannel <- err
-					return
-				}
-				itemChannel <- items
-			}
-			doneChannel <- struct{}{}
-		}()
+	stmt, err := tx.Preparex("INSERT OR REPLACE INTO tradeable_items (id) VALUES (?)")
+	if err != nil {
+		return err
 	}
+	defer stmt.Close()
 
-	// distribute work
-	go func() {
-		for i := 0; i < len(itemIds); i += batchSize {
-			end := i + batchSize
-			if end > len(itemIds) {
-				end = len(itemIds)
-			}
-			itemIdsChannel <- itemIds[i:end]
+	for _, id := range tradeableItemIds {
+		_, err = stmt.Exec(id)
+		if err != nil {
+			tx.Rollback()
+			return err
 		}
-		close(itemIdsChannel)
-	}()
+	}
 
-	items := []Item{}
-	completedGoroutines := 0
-	for completedGoroutines < concurrency {
-		select {
-		case itemBatch := <-itemChannel:
-			items = append(items, itemBatch...)
-		case err := <-errorChannel:
-			return []Item{}, err
-		case <-doneChannel:
-			completedGoroutines++
-		}
+	err = tx.Commit()
+	if err != nil {
+		return err
 	}
-	return items, nil
+
+	return nil
+}
+
+// updateRecipeCache stores the given recipes in the local cache
+func updateRecipeCache(db *sqlx.DB, recipes []Recipe) error {
+	return writeRecipes(db, func(yield func(Recipe) error) error {
+		for _, recipe := range recipes {
+			if err := yield(recipe); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-func updateMerchantOfferings(db *sqlx.DB, merchants []Merchant) error {
-	logger.Debug("Updating local merchant data")
-	logger.Debug("Loaded Merchant data", "sizeMerchants", len(merchants))
-	createMerchantTableQuery := `
-    CREATE TABLE IF NOT EXISTS merchants (
-      id INTEGER PRIMARY KEY AUTOINCREMENT,
-      name TEXT NOT NULL,
-      locations TEXT NOT NULL,
-      display_name TEXT
-    );
-  `
-	createPurchaseOptionsTableQuery := `
-    CREATE TABLE IF NOT EXISTS purchase_options (
-      id INTEGER PRIMARY KEY AUTOINCREMENT,
-      type TEXT NOT NULL,
-      item_id INTEGER NOT NULL,
-      count INTEGER NOT NULL,
-      ignore BOOLEAN NOT NULL,
-      merchant_id INTEGER,
-      FOREIGN KEY (merchant_id) REFERENCES merchants (id)
-    );
-  `
-	createMerchantPricesTableQuery := `
-    CREATE TABLE IF NOT EXISTS merchant_prices (
-      id INTEGER PRIMARY KEY AUTOINCREMENT,
-      type TEXT NOT NULL,
-      currency_id INTEGER NOT NULL,
-      count INTEGER NOT NULL,
-      purchase_option_id INTEGER,
-      FOREIGN KEY (purchase_option_id) REFERENCES purchase_options (id)
-    );
-  `
-	_, err := db.Exec(createMerchantTableQuery)
+// writeRecipes upserts the recipes produced by stream in a single transaction,
+// writing each one as it arrives
+func writeRecipes(db *sqlx.DB, stream func(yield func(Recipe) error) error) error {
+	logger.Debug("Updating local Recipe cache")
+	// create transation object
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	upsertRecipe, err := tx.Preparex(`
+		INSERT INTO recipes (id, type, output_item_id, output_item_count, disciplines, min_rating, flags, output_upgrade_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			type = excluded.type,
+			output_item_id = excluded.output_item_id,
+			output_item_count = excluded.output_item_count,
+			disciplines = excluded.disciplines,
+			min_rating = excluded.min_rating,
+			flags = excluded.flags,
+			output_upgrade_id = excluded.output_upgrade_id;
+  `)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	_, err = db.Exec(createPurchaseOptionsTableQuery)
+	defer upsertRecipe.Close()
+	upsertIngredient, err := tx.Preparex(`
+		INSERT INTO ingredients (item_id, count, recipe_id)
+		VALUES (?, ?, ?)
+		ON CONFLICT(item_id, recipe_id) DO UPDATE SET
+			count = excluded.count
+  `)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	_, err = db.Exec(createMerchantPricesTableQuery)
+	defer upsertIngredient.Close()
+	upsertGuildIngredient, err := tx.Preparex(`
+		INSERT INTO guild_ingredients (upgrade_id, count, recipe_id)
+		VALUES (?, ?, ?)
+		ON CONFLICT(upgrade_id, recipe_id) DO UPDATE SET
+			count = excluded.count
+  `)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	for _, merchant := range merchants {
-		res, err := db.Exec(`INSERT INTO merchants (name, locations, display_name) VALUES (?, ?, ?)`,
-			merchant.Name, strings.Join(merchant.Locations, ","), merchant.DisplayName)
-		if err != nil {
-			return err
-		}
-
-		merchantID, err := res.LastInsertId()
+	defer upsertGuildIngredient.Close()
+
+	count := 0
+	err = stream(func(recipe Recipe) error {
+		_, err := upsertRecipe.Exec(
+			recipe.ID,
+			recipe.Type,
+			recipe.OutputItemID,
+			recipe.OutputItemCount,
+			strings.Join(recipe.Disciplines, ","),
+			recipe.MinRating,
+			strings.Join(recipe.Flags, ","),
+			recipe.OutputUpgradeID,
+		)
 		if err != nil {
-			return err
+			return fmt.Errorf("Error upserting recipe %d: %w", recipe.ID, err)
 		}
-
-		for _, option := range merchant.PurchaseOptions {
-			res, err := db.Exec(`INSERT INTO purchase_options (type, item_id, count, ignore, merchant_id) VALUES (?, ?, ?, ?, ?)`,
-				option.Type, option.ID, option.Count, option.Ignore, merchantID)
+		for _, ingredient := range recipe.Ingredients {
+			_, err := upsertIngredient.Exec(ingredient.ItemID, ingredient.Count, recipe.ID)
 			if err != nil {
-				return err
+				return fmt.Errorf("Error upserting ingredient %d for recipe %d: %w", ingredient.ItemID, recipe.ID, err)
 			}
-
-			optionID, err := res.LastInsertId()
+		}
+		for _, guildIngredient := range recipe.GuildIngredients {
+			_, err := upsertGuildIngredient.Exec(guildIngredient.UpgradeID, guildIngredient.Count, recipe.ID)
 			if err != nil {
-				return err
-			}
-
-			for _, price := range option.Price {
-				_, err := db.Exec(`INSERT INTO merchant_prices (type, currency_id, count, purchase_option_id) VALUES (?, ?, ?, ?)`,
-					price.Type, price.ID, price.Count, optionID)
-				if err != nil {
-					return err
-				}
+				return fmt.Errorf("Error upserting guild ingredient %d for recipe %d: %w", guildIngredient.UpgradeID, recipe.ID, err)
 			}
 		}
-	}
-	return nil
-}
-
-func updateBuildMetadata(db *sqlx.DB, buildMetadata Metadata) error {
-	if err := createMetadataTableIfNotExists(db); err != nil {
+		count++
+		return nil
+	})
+	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
-	query := "UPDATE metadata set build_number = ?"
-	_, err := db.Exec(query, buildMetadata.BuildNumber)
-	return err
-}
-
-func updateTradeableItemsCache(db *sqlx.DB, tradeableItemIds []int) error {
-	logger.Debug("Updating local tradeable items cache")
-	createTableQuery := `
-    CREATE TABLE IF NOT EXISTS tradeable_items (
-			id INTEGER PRIMARY KEY
-		);
-    CREATE INDEX IF NOT EXISTS idx_tradeable_items_id ON tradeable_items (id);
-  `
-	_, err := db.Exec(createTableQuery)
-	if err != nil {
-		return err
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to commit transiction while updating recipe cache: %w", err)
 	}
+	logger.Debug("Updated local Recipe cache", "size", count)
+	return nil
+}
 
+func updateCurrencyCache(db *sqlx.DB, currencies []Currency) error {
+	logger.Debug("Updating in-game currency cache")
 	tx, err := db.Beginx()
 	if err != nil {
 		return err
 	}
 
-	stmt, err := tx.Preparex("INSERT OR REPLACE INTO tradeable_items (id) VALUES (?)")
+	stmt, err := tx.Preparex("INSERT OR REPLACE INTO currencies (id, name, description) VALUES (?, ?, ?)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for _, id := range tradeableItemIds {
-		_, err = stmt.Exec(id)
+	for _, currency := range currencies {
+		_, err = stmt.Exec(currency.ID, currency.Name, currency.Description)
 		if err != nil {
 			tx.Rollback()
 			return err
@@ -398,323 +380,269 @@ func updateTradeableItemsCache(db *sqlx.DB, tradeableItemIds []int) error {
 	return nil
 }
 
-func updateMerchantCache(db *sqlx.DB, merchants []Merchant) error {
-	logger.Debug("Updating local Merchant cache...")
-	createtableQuery := `
-    CREATE TABLE IF NOT EXISTS merchants (
-      id INTEGER PRIMARY KEY AUTOINCREMENT,
-      name TEXT,
-      display_name TEXT,
-      locations TEXT
-     );
-
-     CREATE TABLE IF NOT EXISTS purchase_options (
-      id INTEGER PRIMARY KEY,
-      merchant_id INTEGER,
-      type TEXT,
-      item_id INTEGER,
-      count INTEGER,
-      ignore BOOLEAN,
-      FOREIGN KEY(merchant_id) REFERENCES merchants(id),
-      UNIQUE(item_id, merchant_id)
-    );
-
-    CREATE TABLE IF NOT EXISTS prices (
-      id INTEGER PRIMARY KEY,
-      purchase_option_id INTEGER,
-      type TEXT,
-      currency_id INTEGER,
-      count INTEGER,
-      FOREIGN KEY(purchase_option_id) REFERENCES purchase_options(id),
-      UNIQUE(currency_id, purchase_option_id)
-    );
-  `
-	_, err := db.Exec(createtableQuery)
+func updateGuildUpgradeCache(db *sqlx.DB, upgrades []GuildUpgrade) error {
+	logger.Debug("Updating local guild upgrade cache")
+	tx, err := db.Beginx()
 	if err != nil {
 		return err
 	}
-	// create transaction object
-	tx, err := db.Beginx()
+	// Costs have no natural key, so upgrades are replaced as a whole
+	_, err = tx.Exec("DELETE FROM guild_upgrade_costs; DELETE FROM guild_upgrades;")
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-
-	upsertMerchantStmt := `
-		INSERT INTO merchants (name, display_name, locations)
-		VALUES (?, ?, ?)
-		ON CONFLICT(name, display_name, locations) DO UPDATE SET
-			name = excluded.name,
-			display_name = excluded.display_name,
-			locations = excluded.locations;
-  `
-	upsertPurchaseOptionStmt := `
-		INSERT INTO purchase_options (merchant_id, type, item_id, count, ignore)
-		VALUES (?, ?, ?, ?, ?)
-		ON CONFLICT(item_id, merchant_id) DO UPDATE SET
-			type = excluded.type,
-			count = excluded.count,
-			ignore = excluded.ignore
-  `
-	upsertPriceStmt := `
-		INSERT INTO prices (purchase_option_id, type, currency_id, count)
-		VALUES (?, ?, ?, ?)
-		ON CONFLICT(currency_id, purchase_option_id) DO UPDATE SET
-			type = excluded.type,
-			count = excluded.count
-  `
-
-	for _, merchant := range merchants {
-		result, err := tx.Exec(upsertMerchantStmt, merchant.Name, merchant.DisplayName, strings.Join(merchant.Locations, ","))
+	for _, upgrade := range upgrades {
+		_, err = tx.Exec("INSERT INTO guild_upgrades (id, name, description, type, required_level) VALUES (?, ?, ?, ?, ?)",
+			upgrade.ID, upgrade.Name, upgrade.Description, upgrade.Type, upgrade.RequiredLevel)
 		if err != nil {
 			tx.Rollback()
-			return fmt.Errorf("Error upserting merchant %s: %w", merchant.Name, err)
+			return fmt.Errorf("Error inserting guild upgrade %d: %w", upgrade.ID, err)
 		}
-		merchantID, err := result.LastInsertId()
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("Error getting last inserted merchant ID: %w", err)
-		}
-		for _, option := range merchant.PurchaseOptions {
-			_, err := tx.Exec(upsertPurchaseOptionStmt, merchantID, option.Type, option.ID, option.Count, option.Ignore)
+		for _, cost := range upgrade.Costs {
+			_, err = tx.Exec("INSERT INTO guild_upgrade_costs (upgrade_id, type, name, count, item_id) VALUES (?, ?, ?, ?, ?)",
+				upgrade.ID, cost.Type, cost.Name, cost.Count, cost.ItemID)
 			if err != nil {
 				tx.Rollback()
-				return fmt.Errorf("Error upserting purchase option %d for merchant %d: %w", option.ID, merchantID, err)
-			}
-
-			for _, price := range option.Price {
-				_, err := tx.Exec(upsertPriceStmt, option.ID, price.Type, price.ID, price.Count)
-				if err != nil {
-					tx.Rollback()
-					return fmt.Errorf("Error upserting price %d for purchase option %d: %w", price.ID, option.ID, err)
-				}
+				return fmt.Errorf("Error inserting cost for guild upgrade %d: %w", upgrade.ID, err)
 			}
 		}
 	}
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("Failed to commit transaction while updating merchant cache: %w", err)
-	}
-	return nil
+
+	return tx.Commit()
 }
 
-func updateRecipeCache(db *sqlx.DB, recipes []Recipe) error {
-	logger.Debug("Updating local Recipe cache")
-	createtableQuery := `
-    CREATE TABLE IF NOT EXISTS recipes (
-      id INTEGER PRIMARY KEY,
-      type TEXT,
-      output_item_id INTEGER,
-      output_item_count INTEGER,
-      disciplines TEXT,
-      min_rating INTEGER,
-      flags TEXT
-     );
-
-     CREATE TABLE IF NOT EXISTS ingredients (
-      id INTEGER PRIMARY KEY,
-      item_id INTEGER,
-      count INTEGER,
-      recipe_id INTEGER,
-      FOREIGN KEY(recipe_id) REFERENCES recipes(id),
-      UNIQUE(item_id, recipe_id)
-    );
-  `
-	_, err := db.Exec(createtableQuery)
+func updateMaterialCategoryCache(db *sqlx.DB, categories []MaterialCategory) error {
+	logger.Debug("Updating local material category cache")
+	tx, err := db.Beginx()
 	if err != nil {
 		return err
 	}
-	// create transation object
-	tx, err := db.Beginx()
+	// Categories are small, so they are replaced as a whole to drop removed items
+	_, err = tx.Exec("DELETE FROM material_category_items; DELETE FROM material_categories;")
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-
-	// Use a waitGroup to ensure all upserts are done before commiting
-	var wg sync.WaitGroup
-	errorsChan := make(chan error, len(recipes))
-	upsertRecipeStmt := `
-		INSERT INTO recipes (id, type, output_item_id, output_item_count, disciplines, min_rating, flags)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(id) DO UPDATE SET
-			type = excluded.type,
-			output_item_id = excluded.output_item_id,
-			output_item_count = excluded.output_item_count,
-			disciplines = excluded.disciplines,
-			min_rating = excluded.min_rating,
-			flags = excluded.flags;
-  `
-	upsertIngredientStmt := `
-		INSERT INTO ingredients (item_id, count, recipe_id)
-		VALUES (?, ?, ?)
-		ON CONFLICT(item_id, recipe_id) DO UPDATE SET
-			count = excluded.count
-  `
-	for _, recipe := range recipes {
-		wg.Add(1)
-		go func(recipe Recipe) {
-			defer wg.Done()
-
-			_, err := tx.Exec(upsertRecipeStmt,
-				recipe.ID,
-				recipe.Type,
-				recipe.OutputItemID,
-				recipe.OutputItemCount,
-				strings.Join(recipe.Disciplines, ","),
-				recipe.MinRating,
-				strings.Join(recipe.Flags, ","),
-			)
+	for _, category := range categories {
+		_, err = tx.Exec("INSERT INTO material_categories (id, name, sort_order) VALUES (?, ?, ?)", category.ID, category.Name, category.Order)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Error inserting material category %d: %w", category.ID, err)
+		}
+		for _, itemID := range category.Items {
+			_, err = tx.Exec("INSERT OR IGNORE INTO material_category_items (category_id, item_id) VALUES (?, ?)", category.ID, itemID)
 			if err != nil {
-				errorsChan <- fmt.Errorf("Error upserting recipe %d: %w", recipe.ID, err)
-				return
+				tx.Rollback()
+				return fmt.Errorf("Error inserting item %d for material category %d: %w", itemID, category.ID, err)
 			}
+		}
+	}
 
-			for _, ingredient := range recipe.Ingredients {
-				_, err := tx.Exec(upsertIngredientStmt, ingredient.ItemID, ingredient.Count, recipe.ID)
-				if err != nil {
-					errorsChan <- fmt.Errorf("Error upserting ingredient %d for recipe %d: %w", ingredient.ItemID, recipe.ID, err)
-					return
-				}
-			}
-		}(recipe)
+	return tx.Commit()
+}
+
+// updateDailyCraftingCache marks the recipes producing time-gated items. The API
+// only provides IDs like "lump_of_mithrillium", so they are matched against the
+// cached item names, which requires the recipe and item caches to be up to date.
+func updateDailyCraftingCache(db *sqlx.DB, dailyCraftingIDs []string) error {
+	logger.Debug("Updating local daily crafting cache")
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM daily_crafting")
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
-	// Wait for all upserts to finish
-	wg.Wait()
-	close(errorsChan)
-	// Check if we had any errors during upsert
-	for err := range errorsChan {
+	for _, dailyID := range dailyCraftingIDs {
+		res, err := tx.Exec(`
+			INSERT OR REPLACE INTO daily_crafting (recipe_id, daily_id)
+			SELECT r.id, ? FROM recipes r
+			JOIN items i ON i.id = r.output_item_id
+			WHERE lower(replace(i.name, ' ', '_')) = ?
+		`, dailyID, dailyID)
 		if err != nil {
 			tx.Rollback()
-			return err
+			return fmt.Errorf("Error marking daily crafting recipes for %s: %w", dailyID, err)
+		}
+		if matched, err := res.RowsAffected(); err == nil && matched == 0 {
+			logger.Warn("No recipe found for daily craft", "dailyID", dailyID)
 		}
 	}
 
-	// Commit transaction
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("Failed to commit transiction while updating recipe cache: %w", err)
-	}
-	return nil
+	return tx.Commit()
 }
 
-func updateCurrencyCache(db *sqlx.DB, currencies []Currency) error {
-	logger.Debug("Updating in-game currency cache")
-	createTableQuery := `
-    CREATE TABLE IF NOT EXISTS currencies (
-      id INTEGER PRIMARY KEY,
-      name TEXT,
-      description TEXT
-    );
-  `
-	_, err := db.Exec(createTableQuery)
+// marshalItemDetails encodes the JSON columns of an item
+func marshalItemDetails(item Item) (string, string, string, error) {
+	details, err := json.Marshal(item.Details)
 	if err != nil {
-		return err
+		return "", "", "", err
 	}
-
-	tx, err := db.Beginx()
+	upgradesInto, err := json.Marshal(item.UpgradesInto)
 	if err != nil {
-		return err
+		return "", "", "", err
+	}
+	upgradesFrom, err := json.Marshal(item.UpgradesFrom)
+	if err != nil {
+		return "", "", "", err
 	}
+	return string(details), string(upgradesInto), string(upgradesFrom), nil
+}
 
-	stmt, err := tx.Preparex("INSERT OR REPLACE INTO currencies (id, name, description) VALUES (?, ?, ?)")
+// addMissingColumns adds the given column definitions to a table when not present yet
+func addMissingColumns(db sqlx.Ext, tableName string, columnDefinitions []string) error {
+	var existingColumns []string
+	err := sqlx.Select(db, &existingColumns, "SELECT name FROM pragma_table_info(?)", tableName)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-
-	for _, currency := range currencies {
-		_, err = stmt.Exec(currency.ID, currency.Name, currency.Description)
+	for _, definition := range columnDefinitions {
+		columnName := strings.Fields(definition)[0]
+		if slices.Contains(existingColumns, columnName) {
+			continue
+		}
+		logger.Info("Adding missing column to local cache", "table", tableName, "column", columnName)
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", tableName, definition))
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
+// updateItemCache stores the given items in the local cache
 func updateItemCache(db *sqlx.DB, items []Item) error {
-	logger.Debug("Updating local Item cache...")
-	createTableQuery := `
-    CREATE TABLE IF NOT EXISTS items (
-      id INTEGER PRIMARY KEY,
-      name TEXT,
-      type TEXT,
-      rarity TEXT,
-      vendor_value INTEGER,
-      flags TEXT
-    );
-  `
-	_, err := db.Exec(createTableQuery)
-	if err != nil {
-		return err
-	}
+	return writeItems(db, func(yield func(Item) error) error {
+		for _, item := range items {
+			if err := yield(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
+// writeItems upserts the items produced by stream in a single transaction,
+// writing each one as it arrives
+func writeItems(db *sqlx.DB, stream func(yield func(Item) error) error) error {
+	logger.Debug("Updating local Item cache...")
 	// create transaction object
 	tx, err := db.Beginx()
 	if err != nil {
 		return err
 	}
-
-	// Use a waitGroup to ensure all upserts are done before committing
-	var wg sync.WaitGroup
-	errorsChan := make(chan error, len(items))
-	upsertItemStmt := `
-		INSERT INTO items (id, name, type, rarity, vendor_value, flags)
-		VALUES (?, ?, ?, ?, ?, ?)
+	upsertItem, err := tx.Preparex(`
+		INSERT INTO items (id, name, type, rarity, vendor_value, flags, level, description, chat_link, restrictions, details, upgrades_into, upgrades_from)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(id) DO UPDATE SET
 			name = excluded.name,
 			type = excluded.type,
 			rarity = excluded.rarity,
 			vendor_value = excluded.vendor_value,
-			flags = excluded.flags;
-  `
-
-	for _, item := range items {
-		wg.Add(1)
-		go func(item Item) {
-			defer wg.Done()
-
-			_, err := tx.Exec(upsertItemStmt,
-				item.ID,
-				item.Name,
-				item.Type,
-				item.Rarity,
-				item.VendorValue,
-				strings.Join(item.Flags, ","),
-			)
-			if err != nil {
-				errorsChan <- fmt.Errorf("Error upserting item %d: %w", item.ID, err)
-				return
-			}
-		}(item)
+			flags = excluded.flags,
+			level = excluded.level,
+			description = excluded.description,
+			chat_link = excluded.chat_link,
+			restrictions = excluded.restrictions,
+			details = excluded.details,
+			upgrades_into = excluded.upgrades_into,
+			upgrades_from = excluded.upgrades_from;
+  `)
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
+	defer upsertItem.Close()
 
-	// Wait for all upserts to finish
-	wg.Wait()
-	close(errorsChan)
-
-	// Check if we had any errors during upsert
-	for err := range errorsChan {
+	count := 0
+	err = stream(func(item Item) error {
+		details, upgradesInto, upgradesFrom, err := marshalItemDetails(item)
 		if err != nil {
-			tx.Rollback()
-			return err
+			return fmt.Errorf("Error encoding details for item %d: %w", item.ID, err)
+		}
+		_, err = upsertItem.Exec(
+			item.ID,
+			item.Name,
+			item.Type,
+			item.Rarity,
+			item.VendorValue,
+			strings.Join(item.Flags, ","),
+			item.Level,
+			item.Description,
+			item.ChatLink,
+			strings.Join(item.Restrictions, ","),
+			details,
+			upgradesInto,
+			upgradesFrom,
+		)
+		if err != nil {
+			return fmt.Errorf("Error upserting item %d: %w", item.ID, err)
 		}
+		count++
+		return nil
+	})
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
 	// Commit transaction
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("Failed to commit transaction while updating item cache: %w", err)
 	}
+	logger.Debug("Updated local Item cache", "size", count)
 	return nil
 }
 
+// SyncTransactionHistory stores the account's fulfilled Trading Post orders
+// in the local cache. The API only keeps the last 90 days of history, so
+// running this regularly preserves older transactions.
+func SyncTransactionHistory(client *APIClient, db *sqlx.DB) error {
+	for _, side := range []TransactionSide{TransactionSideBuys, TransactionSideSells} {
+		transactions, err := client.FetchTransactionHistory(side)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch %s transaction history: %w", side, err)
+		}
+		err = updateTransactionCache(db, side, transactions)
+		if err != nil {
+			return fmt.Errorf("Failed to update %s transaction cache: %w", side, err)
+		}
+	}
+	return nil
+}
+
+func updateTransactionCache(db *sqlx.DB, side TransactionSide, transactions []Transaction) error {
+	logger.Debug("Updating local transaction history cache", "side", side, "size", len(transactions))
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Preparex("INSERT OR REPLACE INTO transactions (id, side, item_id, price, quantity, created, purchased) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, transaction := range transactions {
+		// Timestamps are stored in UTC so they can be compared as text
+		_, err = stmt.Exec(transaction.ID, side, transaction.ItemID, transaction.Price, transaction.Quantity, transaction.Created.UTC(), transaction.Purchased.UTC())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func loadRecipeCache(db *sqlx.DB) ([]Recipe, error) {
-	rows, err := db.Queryx("SELECT id, type, output_item_id, output_item_count, disciplines, min_rating, flags FROM recipes")
+	rows, err := db.Queryx("SELECT id, type, output_item_id, output_item_count, disciplines, min_rating, flags, output_upgrade_id FROM recipes ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
@@ -724,68 +652,52 @@ func loadRecipeCache(db *sqlx.DB) ([]Recipe, error) {
 	var recipes []Recipe
 	for rows.Next() {
 		var recipe Recipe
-		var disciplines, flags string
-		if err := rows.Scan(&recipe.ID, &recipe.Type, &recipe.OutputItemID, &recipe.OutputItemCount, &disciplines, &recipe.MinRating, &flags); err != nil {
+		if err := rows.Scan(&recipe.ID, &recipe.Type, &recipe.OutputItemID, &recipe.OutputItemCount, &recipe.Disciplines, &recipe.MinRating, &recipe.Flags, &recipe.OutputUpgradeID); err != nil {
 			return nil, err
 		}
-		recipe.Disciplines = strings.Split(disciplines, ",")
-		recipe.Flags = strings.Split(flags, ",")
 		recipes = append(recipes, recipe)
 	}
 
 	// Fetch Ingredients
-	rows, err = db.Queryx("SELECT item_id, count, recipe_id FROM ingredients")
+	rows, err = db.Queryx("SELECT id, item_id, count, recipe_id FROM ingredients ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	// stuff like stuff
 	ingredients := make(map[int][]Ingredient)
 	for rows.Next() {
 		var ingredient Ingredient
-		var recipeID int
-		if err := rows.Scan(&ingredient.ItemID, &ingredient.Count, &recipeID); err != nil {
+		if err := rows.Scan(&ingredient.ID, &ingredient.ItemID, &ingredient.Count, &ingredient.RecipeID); err != nil {
 			return nil, err
 		}
-		ingredients[recipeID] = append(ingredients[recipeID], ingredient)
-	}
-
-	for i, recipe := range recipes {
-		if ing, ok := ingredients[recipe.ID]; ok {
-			recipes[i].Ingredients = ing
-		}
+		ingredients[ingredient.RecipeID] = append(ingredients[ingredient.RecipeID], ingredient)
 	}
 
-	return recipes, nil
-}
-
-func createMetadataTableIfNotExists(db *sqlx.DB) error {
-	createTableQuery := `
-    CREATE TABLE IF NOT EXISTS metadata (
-			build_number INTEGER PRIMARY KEY
-		)
-  `
-	_, err := db.Exec(createTableQuery)
+	// Fetch Guild Ingredients
+	rows, err = db.Queryx("SELECT id, upgrade_id, count, recipe_id FROM guild_ingredients ORDER BY id")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Check if the metadata table is empty
-	checkEmptyQuery := "SELECT COUNT(*) FROM metadata"
-	var count int
-	err = db.Get(&count, checkEmptyQuery)
-	if err != nil {
-		return err
+	defer rows.Close()
+
+	guildIngredients := make(map[int][]GuildIngredient)
+	for rows.Next() {
+		var guildIngredient GuildIngredient
+		if err := rows.Scan(&guildIngredient.ID, &guildIngredient.UpgradeID, &guildIngredient.Count, &guildIngredient.RecipeID); err != nil {
+			return nil, err
+		}
+		guildIngredients[guildIngredient.RecipeID] = append(guildIngredients[guildIngredient.RecipeID], guildIngredient)
 	}
 
-	// If the table is empty, insert initial data structure
-	if count == 0 {
-		insertInitialDataQuery := "INSERT INTO metadata (build_number) VALUES (?)"
-		_, err := db.Exec(insertInitialDataQuery, 0) // Set initial build number
-		if err != nil {
-			return err
+	for i, recipe := range recipes {
+		if ing, ok := ingredients[recipe.ID]; ok {
+			recipes[i].Ingredients = ing
+		}
+		if guildIng, ok := guildIngredients[recipe.ID]; ok {
+			recipes[i].GuildIngredients = guildIng
 		}
 	}
 
-	return nil
+	return recipes, nil
 }
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
 )
 
 func generateItemIds(size int) []int {
@@ -21,11 +25,8 @@ func generateItemIds(size int) []int {
 }
 
 func BenchmarkUpdateTradeableItemsCache(b *testing.B) {
-	db, err := sqlx.Connect("sqlite3", ":memory:")
-	if err != nil {
-		b.Fatal(err)
-	}
-	defer db.Close()
+	db, cleanup := setupDB(b)
+	defer cleanup()
 
 	// Test performance for different batch sizes
 	for _, size := range []int{100, 1000, 10000} {
@@ -42,3 +43,112 @@ func BenchmarkUpdateTradeableItemsCache(b *testing.B) {
 		})
 	}
 }
+
+func TestRefreshItemCache(t *testing.T) {
+	fake := fakeapi.New()
+	// More items than fit in a single batch
+	for id := 1; id <= 450; id++ {
+		if err := fake.AddItems(Item{ID: id, Name: fmt.Sprintf("Item %d", id), Type: "CraftingMaterial"}); err != nil {
+			t.Fatalf("Failed to seed items: %v", err)
+		}
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := NewAPIClient(server.URL, "token")
+
+	db, cleanup := setupDB(t)
+	defer cleanup()
+
+	itemIds, err := client.FetchAllItemsIds()
+	if err != nil {
+		t.Fatalf("FetchAllItemsIds() returned error: %v", err)
+	}
+	if err := refreshItemCache(client, db, itemIds); err != nil {
+		t.Fatalf("refreshItemCache() returned error: %v", err)
+	}
+	var count int
+	if err := db.Get(&count, "SELECT COUNT(*) FROM items"); err != nil {
+		t.Fatal(err)
+	}
+	if count != 450 {
+		t.Errorf("Cached %d items, want 450", count)
+	}
+	var name string
+	if err := db.Get(&name, "SELECT name FROM items WHERE id = 321"); err != nil || name != "Item 321" {
+		t.Errorf("Item 321 name = %q (%v), want \"Item 321\"", name, err)
+	}
+}
+
+func TestStreamBatchesFromAPIStopsOnYieldError(t *testing.T) {
+	fake := fakeapi.New()
+	var ids []int
+	for id := 1; id <= 1000; id++ {
+		ids = append(ids, id)
+		if err := fake.AddItems(Item{ID: id}); err != nil {
+			t.Fatalf("Failed to seed items: %v", err)
+		}
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := NewAPIClient(server.URL, "token")
+
+	yielded := 0
+	errFull := errors.New("full")
+	err := streamBatchesFromAPI(client, "/items", ids, func(item Item) error {
+		yielded++
+		if yielded == 10 {
+			return errFull
+		}
+		return nil
+	})
+	if !errors.Is(err, errFull) {
+		t.Errorf("streamBatchesFromAPI() error = %v, want %v", err, errFull)
+	}
+	if yielded != 10 {
+		t.Errorf("yield called %d times, want 10", yielded)
+	}
+}
+
+func TestResolveCachePath(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", "/xdg/cache")
+	tests := []struct {
+		name       string
+		flagPath   string
+		envPath    string
+		configPath string
+		want       string
+	}{
+		{name: "Flag wins", flagPath: "flag.db", envPath: "env.db", configPath: "config.db", want: "flag.db"},
+		{name: "Environment before config", envPath: "env.db", configPath: "config.db", want: "env.db"},
+		{name: "Config", configPath: "config.db", want: "config.db"},
+		{name: "In-memory", configPath: InMemoryCache, want: InMemoryCache},
+		{name: "User cache directory by default", want: filepath.Join("/xdg/cache", "gw2-mastercrafter", "cache.db")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(cachePathEnv, tt.envPath)
+			got, err := ResolveCachePath(tt.flagPath, tt.configPath)
+			if err != nil {
+				t.Fatalf("ResolveCachePath() returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveCachePath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenCacheCreatesDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "cache.db")
+	db, err := OpenCache(path)
+	if err != nil {
+		t.Fatalf("OpenCache() returned error: %v", err)
+	}
+	defer db.Close()
+	if version, err := schemaVersion(db); err != nil || version != latestSchemaVersion() {
+		t.Errorf("schemaVersion() = %d, %v, want %d", version, err, latestSchemaVersion())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Cache file was not created: %v", err)
+	}
+}
@@ -1,26 +1,96 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
+const transactionsPageSize = 200 // Maximum page size accepted by the API
+
 type APIClient struct {
-	baseURL   string
-	authToken string
+	baseURL       string
+	authToken     string
+	responseCache *ResponseCache    // optional on-disk cache for responses
+	transport     http.RoundTripper // base transport, a pooled keep-alive transport when nil
+	proxyURL      *url.URL          // proxy for the default transport
+	middleware    []Middleware      // wrappers around the transport, outermost first
+	buildSources  []BuildSource     // build number sources in fallback order
+	metrics       *RequestMetrics   // per-endpoint request metrics
+	http          *http.Client      // shared client so connections are reused
+}
+
+// A ClientOption configures optional behaviour of an APIClient
+type ClientOption func(*APIClient)
+
+// WithResponseCache reuses fresh responses from the given cache and revalidates stale ones
+func WithResponseCache(responseCache *ResponseCache) ClientOption {
+	return func(client *APIClient) {
+		client.responseCache = responseCache
+	}
 }
 
 func (client APIClient) String() string {
 	return fmt.Sprintf("API Client{baseURL: %s, authToken: ########}", client.baseURL)
 }
 
-func NewAPIClient(baseURL, authToken string) *APIClient {
-	return &APIClient{baseURL: baseURL, authToken: authToken}
+// WithTransport sends requests through the given transport, e.g. to record or replay traffic
+func WithTransport(transport http.RoundTripper) ClientOption {
+	return func(client *APIClient) {
+		client.transport = transport
+	}
+}
+
+// WithProxy sends requests through the given proxy. It only applies to the
+// default transport; a transport set with WithTransport handles its own proxying.
+func WithProxy(proxyURL *url.URL) ClientOption {
+	return func(client *APIClient) {
+		client.proxyURL = proxyURL
+	}
+}
+
+// WithMiddleware wraps the transport with the given middleware, the first one
+// seeing requests first. Calling it again appends to the chain.
+func WithMiddleware(middleware ...Middleware) ClientOption {
+	return func(client *APIClient) {
+		client.middleware = append(client.middleware, middleware...)
+	}
+}
+
+// WithBuildSources replaces the default build number sources, tried in the given order
+func WithBuildSources(sources ...BuildSource) ClientOption {
+	return func(client *APIClient) {
+		client.buildSources = sources
+	}
+}
+
+// WithRequestMetrics records requests into the given metrics, so several clients can report together
+func WithRequestMetrics(metrics *RequestMetrics) ClientOption {
+	return func(client *APIClient) {
+		client.metrics = metrics
+	}
+}
+
+func NewAPIClient(baseURL, authToken string, options ...ClientOption) *APIClient {
+	client := &APIClient{baseURL: baseURL, authToken: authToken, buildSources: DefaultBuildSources, metrics: NewRequestMetrics()}
+	for _, option := range options {
+		option(client)
+	}
+	transport := client.transport
+	if transport == nil {
+		transport = newDefaultTransport(client.proxyURL)
+	} else if client.proxyURL != nil {
+		logger.Warn("Ignoring proxy setting for a custom transport")
+	}
+	client.http = &http.Client{Transport: chainMiddleware(transport, client.middleware)}
+	return client
 }
 
 type APIError struct {
@@ -33,11 +103,24 @@ func (e *APIError) Error() string {
 	return fmt.Sprintf("API request error: StatusCode=%d, RequestPath=%s ,Message=%s", e.StatusCode, e.RequestPath, e.Message)
 }
 
+func newAPIError(endpoint string, response *http.Response) *APIError {
+	return &APIError{
+		StatusCode:  response.StatusCode,
+		RequestPath: endpoint,
+		Message:     fmt.Sprintf("API request error querying [%s]: StatusCode=%s, Response: %+v", endpoint, response.Status, response),
+	}
+}
+
 func isRetriable(httpError error) bool {
 	logger.Debug("Verifying error", "error", httpError)
 	if httpError == nil {
 		return false
 	}
+	var apiErr *APIError
+	if errors.As(httpError, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests {
+		logger.Warn("Request returned 429 status code", "error", httpError)
+		return true
+	}
 	if respErr, ok := httpError.(interface{ Response() *http.Response }); ok {
 		if respErr.Response().StatusCode == http.StatusTooManyRequests {
 			logger.Warn("Request returned 429 status code", "error", httpError)
@@ -55,33 +138,100 @@ func formatIntSliceAsStr(ids []int) string {
 	return strings.Join(idsAsStr, ",")
 }
 
-func (client *APIClient) makeRequest(endpoint string) (*http.Response, error) {
+func (client *APIClient) makeRequest(endpoint string, headers http.Header) (*http.Response, error) {
 	url := client.baseURL + endpoint
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	for key, values := range headers {
+		req.Header[key] = values
+	}
 	req.Header.Set("Authorization", "Bearer "+client.authToken)
-	httpClient := &http.Client{}
-	return httpClient.Do(req)
+	start := time.Now()
+	response, err := client.httpClient().Do(req)
+	statusCode := 0
+	if response != nil {
+		statusCode = response.StatusCode
+	}
+	client.metrics.recordRequest(endpoint, statusCode, time.Since(start))
+	return response, err
 }
 
-func (client *APIClient) fetchAndDecode(endpoint string, targetType interface{}) error {
-	response, err := client.makeRequest(endpoint)
+// Stats returns the request metrics recorded by this client
+func (client *APIClient) Stats() []EndpointStats {
+	return client.metrics.Stats()
+}
+
+func (client *APIClient) httpClient() *http.Client {
+	return client.http
+}
+
+// fetchBody returns the raw body for an endpoint, going through the response
+// cache when one is configured
+func (client *APIClient) fetchBody(endpoint string) ([]byte, error) {
+	var cacheKey string
+	var cached *cachedResponse
+	headers := http.Header{}
+	if client.responseCache != nil {
+		cacheKey = client.responseCache.key(endpoint, client.authToken)
+		cached = client.responseCache.load(cacheKey)
+		if cached != nil {
+			if time.Now().Before(cached.Expires) {
+				logger.Debug("Using cached response", "endpoint", endpoint)
+				return cached.Body, nil
+			}
+			if cached.ETag != "" {
+				headers.Set("If-None-Match", cached.ETag)
+			}
+			if cached.LastModified != "" {
+				headers.Set("If-Modified-Since", cached.LastModified)
+			}
+		}
+	}
+
+	response, err := client.makeRequest(endpoint, headers)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
-		return &APIError{
-			StatusCode:  response.StatusCode,
-			RequestPath: endpoint,
-			Message:     fmt.Sprintf("API request error querying [%s]: StatusCode=%s, Response: %+v", endpoint, response.Status, response),
+	if cached != nil && response.StatusCode == http.StatusNotModified {
+		logger.Debug("Cached response revalidated", "endpoint", endpoint)
+		cached.Expires = client.responseCache.expiry(endpoint, response.Header, time.Now())
+		if err := client.responseCache.store(cacheKey, cached); err != nil {
+			logger.Warn("Failed to update cached response", "endpoint", endpoint, "error", err)
 		}
+		return cached.Body, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, newAPIError(endpoint, response)
 	}
 
 	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.responseCache != nil && cacheable(response.Header) {
+		entry := &cachedResponse{
+			Endpoint:     endpoint,
+			ETag:         response.Header.Get("ETag"),
+			LastModified: response.Header.Get("Last-Modified"),
+			Expires:      client.responseCache.expiry(endpoint, response.Header, time.Now()),
+			Body:         body,
+		}
+		if err := client.responseCache.store(cacheKey, entry); err != nil {
+			logger.Warn("Failed to store cached response", "endpoint", endpoint, "error", err)
+		}
+	}
+
+	return body, nil
+}
+
+func (client *APIClient) fetchAndDecode(endpoint string, targetType interface{}) error {
+	body, err := client.fetchBody(endpoint)
 	if err != nil {
 		return err
 	}
@@ -94,12 +244,76 @@ func (client *APIClient) fetchAndDecode(endpoint string, targetType interface{})
 	return nil
 }
 
-func fetchBuildNumberData(url string) (string, error) {
-	resp, err := http.Get(url)
+// openBody returns a reader over the body of an endpoint. Without a response
+// cache the body is read straight from the network; cached responses have to
+// be buffered in full to be stored, so they are served from memory.
+func (client *APIClient) openBody(endpoint string) (io.ReadCloser, error) {
+	if client.responseCache != nil {
+		body, err := client.fetchBody(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	response, err := client.makeRequest(endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, newAPIError(endpoint, response)
+	}
+	return response.Body, nil
+}
+
+// streamArray decodes a JSON array response one element at a time, passing
+// each to yield, so large responses never have to be held in memory at once
+func streamArray[T any](client *APIClient, endpoint string, yield func(T) error) error {
+	body, err := client.openBody(endpoint)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	if err := expectDelim(decoder, '['); err != nil {
+		return fmt.Errorf("Failed to decode %s: %w", endpoint, err)
+	}
+	for decoder.More() {
+		var element T
+		if err := decoder.Decode(&element); err != nil {
+			return fmt.Errorf("Failed to decode %s: %w", endpoint, err)
+		}
+		if err := yield(element); err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(decoder, ']'); err != nil {
+		return fmt.Errorf("Failed to decode %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("Expected %q, got %v", delim, token)
+	}
+	return nil
+}
+
+func fetchBuildNumberData(httpClient *http.Client, url string) (string, error) {
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Build number request to %s returned %s", url, resp.Status)
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -127,16 +341,12 @@ func parseBuildNumber(data string) (int, error) {
 
 func (client *APIClient) FetchBuildNumber() (Metadata, error) {
 	var metadata Metadata
-	buildNumberData, err := fetchBuildNumberData("http://assetcdn.101.arenanetworks.com/latest/101")
-	if err != nil {
-		return metadata, err
-	}
-	newBuild, err := parseBuildNumber(buildNumberData)
+	newBuild, err := fetchBuildNumberFromSources(client, client.buildSources)
 	if err != nil {
 		return metadata, err
 	}
 	metadata.BuildNumber = newBuild
-	return metadata, err
+	return metadata, nil
 }
 
 func (client *APIClient) FetchAllIds(endpoint string) ([]int, error) {
@@ -187,6 +397,64 @@ func (client *APIClient) FetchKnownRecipesIds() (RecipeIds, error) {
 	return knownRecipeIds, err
 }
 
+// FetchDailyCrafting returns the IDs of the time-gated crafts, e.g. "lump_of_mithrillium"
+func (client *APIClient) FetchDailyCrafting() ([]string, error) {
+	endpoint := "/dailycrafting"
+	var dailyCrafting []string
+	err := client.fetchAndDecode(endpoint, &dailyCrafting)
+	return dailyCrafting, err
+}
+
+// FetchAccountDailyCrafting returns the time-gated crafts the account already made today
+func (client *APIClient) FetchAccountDailyCrafting() ([]string, error) {
+	endpoint := "/account/dailycrafting"
+	var dailyCrafting []string
+	err := client.fetchAndDecode(endpoint, &dailyCrafting)
+	return dailyCrafting, err
+}
+
+// FetchAllGuildUpgrades returns every guild upgrade, fetched in batches of 200
+func (client *APIClient) FetchAllGuildUpgrades() ([]GuildUpgrade, error) {
+	upgradeIds, err := client.FetchAllIds("/guild/upgrades")
+	if err != nil {
+		return nil, err
+	}
+	upgrades := []GuildUpgrade{}
+	for i := 0; i < len(upgradeIds); i += 200 {
+		end := min(i+200, len(upgradeIds))
+		endpoint := fmt.Sprintf("/guild/upgrades?ids=%s", formatIntSliceAsStr(upgradeIds[i:end]))
+		var batch []GuildUpgrade
+		if err := client.fetchAndDecode(endpoint, &batch); err != nil {
+			return nil, err
+		}
+		upgrades = append(upgrades, batch...)
+	}
+	return upgrades, nil
+}
+
+func (client *APIClient) FetchMaterialCategories() ([]MaterialCategory, error) {
+	endpoint := "/materials?ids=all"
+	var categories []MaterialCategory
+	err := client.fetchAndDecode(endpoint, &categories)
+	return categories, err
+}
+
+// FetchCharacters returns every character on the account, requiring the characters permission
+func (client *APIClient) FetchCharacters() ([]Character, error) {
+	endpoint := "/characters?ids=all"
+	var characters []Character
+	err := client.fetchAndDecode(endpoint, &characters)
+	return characters, err
+}
+
+// FetchAccountMaterials returns the contents of the account's material storage
+func (client *APIClient) FetchAccountMaterials() ([]MaterialStack, error) {
+	endpoint := "/account/materials"
+	var materials []MaterialStack
+	err := client.fetchAndDecode(endpoint, &materials)
+	return materials, err
+}
+
 func (client *APIClient) FetchAllRecipesIds() (RecipeIds, error) {
 	endpoint := "/recipes/"
 	var recipeIds RecipeIds
@@ -244,3 +512,43 @@ func (client *APIClient) FetchCurrencies() ([]Currency, error) {
 	err := client.fetchAndDecode(endpoint, &currencies)
 	return currencies, err
 }
+
+// FetchCoinsToGemsRate quotes how many gems the given amount of coins buys
+func (client *APIClient) FetchCoinsToGemsRate(coins int) (*ExchangeRate, error) {
+	endpoint := fmt.Sprintf("/commerce/exchange/coins?quantity=%d", coins)
+	var exchangeRate ExchangeRate
+	err := client.fetchAndDecode(endpoint, &exchangeRate)
+	return &exchangeRate, err
+}
+
+// fetchTransactions walks every page of the given transaction listing, since
+// the API caps each response at transactionsPageSize entries.
+func (client *APIClient) fetchTransactions(state string, side TransactionSide) ([]Transaction, error) {
+	transactions := []Transaction{}
+	for page := 0; ; page++ {
+		endpoint := fmt.Sprintf("/commerce/transactions/%s/%s?page=%d&page_size=%d", state, side, page, transactionsPageSize)
+		var pageData []Transaction
+		err := client.fetchAndDecode(endpoint, &pageData)
+		if err != nil {
+			// Requesting a page past the end returns 400 when the total is an exact multiple of the page size
+			apiErr, ok := err.(*APIError)
+			if ok && page > 0 && apiErr.StatusCode == http.StatusBadRequest {
+				break
+			}
+			return nil, err
+		}
+		transactions = append(transactions, pageData...)
+		if len(pageData) < transactionsPageSize {
+			break
+		}
+	}
+	return transactions, nil
+}
+
+func (client *APIClient) FetchCurrentTransactions(side TransactionSide) ([]Transaction, error) {
+	return client.fetchTransactions("current", side)
+}
+
+func (client *APIClient) FetchTransactionHistory(side TransactionSide) ([]Transaction, error) {
+	return client.fetchTransactions("history", side)
+}
@@ -2,7 +2,12 @@ package main
 
 import (
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
+
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
 )
 
 func TestParseBuildNumber(t *testing.T) {
@@ -29,3 +34,85 @@ func TestParseBuildNumber(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchBuildNumberFallback(t *testing.T) {
+	fake := fakeapi.New()
+	fake.SetBuild(150000)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		sources []BuildSource
+		want    int
+		wantErr bool
+	}{
+		{"CDN manifest", []BuildSource{CDNBuildSource{URL: server.URL + "/latest/101"}}, 150000, false},
+		{"API endpoint", []BuildSource{APIBuildSource{}}, 150000, false},
+		{"Unreachable CDN falls back to API", []BuildSource{CDNBuildSource{URL: server.URL + "/missing"}, APIBuildSource{}}, 150000, false},
+		{"Pinned value is used when others fail", []BuildSource{CDNBuildSource{URL: server.URL + "/missing"}, PinnedBuildSource{BuildNumber: 42}}, 42, false},
+		{"All sources failing returns an error", []BuildSource{CDNBuildSource{URL: server.URL + "/missing"}, PinnedBuildSource{}}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewAPIClient(server.URL, "token", WithBuildSources(tt.sources...))
+			metadata, err := client.FetchBuildNumber()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FetchBuildNumber() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if metadata.BuildNumber != tt.want {
+				t.Errorf("FetchBuildNumber() = %d, want %d", metadata.BuildNumber, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamArray(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/valid":
+			w.Write([]byte(`[{"id": 1, "name": "A"}, {"id": 2, "name": "B"}, {"id": 3, "name": "C"}]`))
+		case "/object":
+			w.Write([]byte(`{"id": 1}`))
+		case "/truncated":
+			w.Write([]byte(`[{"id": 1}, {"id": `))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := NewAPIClient(server.URL, "token")
+
+	tests := []struct {
+		name     string
+		endpoint string
+		stopAt   int // yield fails on this ID when set
+		wantIDs  []int
+		wantErr  bool
+	}{
+		{name: "Array elements are yielded in order", endpoint: "/valid", wantIDs: []int{1, 2, 3}},
+		{name: "Yield errors stop decoding", endpoint: "/valid", stopAt: 2, wantIDs: []int{1, 2}, wantErr: true},
+		{name: "Non array responses are rejected", endpoint: "/object", wantErr: true},
+		{name: "Truncated responses fail after the complete elements", endpoint: "/truncated", wantIDs: []int{1}, wantErr: true},
+		{name: "Error statuses are returned", endpoint: "/missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []int
+			err := streamArray(client, tt.endpoint, func(item Item) error {
+				ids = append(ids, item.ID)
+				if item.ID == tt.stopAt {
+					return errors.New("stop")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("streamArray() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("streamArray() yielded %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
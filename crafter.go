@@ -7,11 +7,19 @@ import (
 	"sort"
 )
 
+const tradingPostFeeMultiplier = 0.85 // Fraction of the sale price kept after listing and exchange fees
+
 // A Crafter uses the API client to request data about pricing of items,
 // while using the localCache to search information on crafting recipes
 type Crafter struct {
-	gw2APIClient APIClient  // underlying API client connection
-	localCache   LocalCache // underlying local SQlite cache
+	gw2APIClient     APIClient       // underlying API client connection
+	localCache       LocalCache      // underlying local SQlite cache
+	gemExchangeRate  *ExchangeRate   // coin to gem rate, fetched on first use
+	craftingRatings  map[string]int  // highest rating per discipline on the account, fetched on first use
+	materials        map[int]int     // material storage counts per item, fetched on first use
+	materialsErr     error           // why the material storage could not be fetched, so it is not retried
+	dailyCraftsDone  map[string]bool // time-gated crafts already made today, fetched on first use
+	dailyCraftsKnown bool            // false when the account's daily crafting could not be fetched
 }
 
 func NewCrafter(gw2APIClient APIClient, localCache LocalCache) *Crafter {
@@ -27,25 +35,86 @@ func (e *NoPurchasingOptionsFoundError) Error() string {
 	return fmt.Sprintf("%s for ItemID=%d", e.Message, e.ItemID)
 }
 
+// Currency IDs as listed by /v2/currencies
+const (
+	coinCurrencyID = 1
+	gemCurrencyID  = 4
+)
+
+// gemExchangeQuoteCoins is the coin amount used to quote the gem exchange rate.
+// Rates worsen with larger quantities, and 100 gold buys a few hundred gems,
+// about the cost of a single gem store item.
+const gemExchangeQuoteCoins = 1000000
+
+// coinsPerGem returns the current price of a gem in coins, fetching it once per crafter
+func (crafter *Crafter) coinsPerGem() (int, error) {
+	if crafter.gemExchangeRate != nil {
+		return crafter.gemExchangeRate.CoinsPerGem, nil
+	}
+	exchangeRate, err := crafter.gw2APIClient.FetchCoinsToGemsRate(gemExchangeQuoteCoins)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to fetch gem exchange rate: %w", err)
+	}
+	crafter.gemExchangeRate = exchangeRate
+	return exchangeRate.CoinsPerGem, nil
+}
+
+// fetchMerchantPrice looks for merchant offerings priced in coin, falling back
+// to gem store offerings valued in coin at the current exchange rate
+func (crafter *Crafter) fetchMerchantPrice(itemID int) (*ItemPrice, error) {
+	hasPurchaseOption, err := crafter.localCache.HasPurchaseOptionWithCurrency(itemID, coinCurrencyID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check for purchasing options: %w", err)
+	}
+	if hasPurchaseOption {
+		merchantPrice, err := crafter.localCache.GetMerchantItemPrice(itemID, coinCurrencyID)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Found merchant price", "itemID", itemID)
+		return merchantPrice, nil
+	}
+
+	hasGemOption, err := crafter.localCache.HasPurchaseOptionWithCurrency(itemID, gemCurrencyID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to check for gem purchasing options: %w", err)
+	}
+	if !hasGemOption {
+		return nil, &NoPurchasingOptionsFoundError{ItemID: itemID, Message: "No purchasing options found"}
+	}
+	gemPrice, err := crafter.localCache.GetMerchantItemPrice(itemID, gemCurrencyID)
+	if err != nil {
+		return nil, err
+	}
+	coinsPerGem, err := crafter.coinsPerGem()
+	if err != nil {
+		return nil, err
+	}
+	coinPrice := gemPrice.Buys.UnitPrice * coinsPerGem
+	logger.Info("Found gem store price", "itemID", itemID, "gems", gemPrice.Buys.UnitPrice, "coinsPerGem", coinsPerGem)
+	return &ItemPrice{
+		ID:    itemID,
+		Buys:  TradingPostPrice{UnitPrice: coinPrice},
+		Sells: TradingPostPrice{UnitPrice: coinPrice},
+	}, nil
+}
+
+// fetchItemTPPrice returns the price of an item, reusing prices fetched recently
+// by any crafter sharing the local cache
 func (crafter *Crafter) fetchItemTPPrice(itemID int) (*ItemPrice, error) {
+	if crafter.localCache.prices == nil {
+		return crafter.fetchItemPriceUncached(itemID)
+	}
+	return crafter.localCache.prices.get(itemID, crafter.fetchItemPriceUncached)
+}
+
+func (crafter *Crafter) fetchItemPriceUncached(itemID int) (*ItemPrice, error) {
 	itemPrice, err := crafter.gw2APIClient.FetchItemPrice(itemID)
 	if err != nil {
 		apiErr, ok := err.(*APIError)
 		if ok && apiErr.StatusCode == http.StatusNotFound {
 			logger.Warn("Item Price not found on TP, checking merchant options", "itemID", itemID)
-			hasPurchaseOption, err := crafter.localCache.HasPurchaseOptionWithCurrency(itemID, "Coin")
-			if err != nil {
-				return nil, fmt.Errorf("Failed to check for purchasing options: %w", err)
-			}
-			if !hasPurchaseOption {
-				return nil, &NoPurchasingOptionsFoundError{ItemID: itemID, Message: "No purchasing options found"}
-			}
-			merchantPrice, err := crafter.localCache.GetMerchantItemPrice(itemID, "Coin")
-			if err != nil {
-				return nil, err
-			}
-			logger.Info("Found merchant price", "itemID", itemID)
-			return merchantPrice, nil
+			return crafter.fetchMerchantPrice(itemID)
 		}
 		return nil, err
 	}
@@ -93,6 +162,97 @@ func (crafter *Crafter) recipeIsAvailable(recipe Recipe) bool {
 	return slices.Contains(knownRecipeIds, recipe.ID)
 }
 
+// hasRequiredDiscipline checks whether any character on the account has one of
+// the recipe's disciplines at the minimum rating. If the API key cannot read
+// characters, the check is skipped.
+func (crafter *Crafter) hasRequiredDiscipline(recipe Recipe) bool {
+	if crafter.craftingRatings == nil {
+		crafter.craftingRatings = make(map[string]int)
+		characters, err := crafter.gw2APIClient.FetchCharacters()
+		if err != nil {
+			logger.Warn("Cannot fetch characters, skipping discipline checks", "error", err)
+			return true
+		}
+		for _, character := range characters {
+			for _, crafting := range character.Crafting {
+				crafter.craftingRatings[crafting.Discipline] = max(crafter.craftingRatings[crafting.Discipline], crafting.Rating)
+			}
+		}
+	}
+	if len(crafter.craftingRatings) == 0 || len(recipe.Disciplines) == 0 {
+		return true
+	}
+	for _, discipline := range recipe.Disciplines {
+		if rating, ok := crafter.craftingRatings[discipline]; ok && rating >= recipe.MinRating {
+			return true
+		}
+	}
+	return false
+}
+
+// craftsFromStorage counts how many times a recipe can be crafted using only material storage
+func (crafter *Crafter) craftsFromStorage(recipe Recipe) (int, error) {
+	if crafter.materialsErr != nil {
+		return 0, crafter.materialsErr
+	}
+	if crafter.materials == nil {
+		materials, err := crafter.gw2APIClient.FetchAccountMaterials()
+		if err != nil {
+			crafter.materialsErr = err
+			return 0, err
+		}
+		crafter.materials = make(map[int]int, len(materials))
+		for _, material := range materials {
+			crafter.materials[material.ItemID] += material.Count
+		}
+	}
+	crafts := -1
+	for _, ingredient := range recipe.Ingredients {
+		if ingredient.Count == 0 {
+			continue
+		}
+		available := crafter.materials[ingredient.ItemID] / ingredient.Count
+		if crafts == -1 || available < crafts {
+			crafts = available
+		}
+	}
+	return max(crafts, 0), nil
+}
+
+// newRecipeProfit builds the profit entry for a recipe, capping daily limited
+// recipes to a single craft unless the account already used it today. If the
+// API key cannot read daily crafting, today's craft is assumed to be available.
+func (crafter *Crafter) newRecipeProfit(recipe Recipe, profitMargin float64) (RecipeProfit, error) {
+	recipeProfit := RecipeProfit{RecipeID: recipe.ID, OutputItemID: recipe.OutputItemID, ProfitMargin: profitMargin, MaxCrafts: -1}
+	dailyID, err := crafter.localCache.GetDailyCraftingID(recipe.ID)
+	if err != nil {
+		return recipeProfit, fmt.Errorf("Failed to check daily crafting limits: %w", err)
+	}
+	if dailyID == "" {
+		return recipeProfit, nil
+	}
+	if crafter.dailyCraftsDone == nil {
+		crafter.dailyCraftsDone = make(map[string]bool)
+		dailyCrafts, err := crafter.gw2APIClient.FetchAccountDailyCrafting()
+		if err != nil {
+			logger.Warn("Cannot fetch account daily crafting, assuming today's crafts are available", "error", err)
+		} else {
+			crafter.dailyCraftsKnown = true
+		}
+		for _, dailyCraft := range dailyCrafts {
+			crafter.dailyCraftsDone[dailyCraft] = true
+		}
+	}
+	recipeProfit.DailyLimited = true
+	recipeProfit.DailyCraftUnknown = !crafter.dailyCraftsKnown
+	recipeProfit.DailyCraftUsed = crafter.dailyCraftsDone[dailyID]
+	recipeProfit.MaxCrafts = 1
+	if recipeProfit.DailyCraftUsed {
+		recipeProfit.MaxCrafts = 0
+	}
+	return recipeProfit, nil
+}
+
 func (crafter *Crafter) itemIsTradeable(itemID int) bool {
 	isTradeable, err := crafter.localCache.ItemIsTradeable(itemID)
 	if err != nil {
@@ -107,10 +267,15 @@ func (crafter *Crafter) itemTypeisAllowed(itemType string) bool {
 
 // A viable recipe is
 // - available (learned)
+// - craftable by a character with the required discipline rating
 // - has an output that is tradeable
 // - the output item type is not present on filtered out options
 func (crafter *Crafter) recipeIsViable(recipe Recipe) bool {
-	return crafter.recipeIsAvailable(recipe) && crafter.itemIsTradeable(recipe.OutputItemID) && crafter.itemTypeisAllowed(recipe.Type)
+	if recipe.OutputItemID == 0 {
+		// Guild recipes produce upgrades, which cannot be sold
+		return false
+	}
+	return crafter.recipeIsAvailable(recipe) && crafter.hasRequiredDiscipline(recipe) && crafter.itemIsTradeable(recipe.OutputItemID) && crafter.itemTypeisAllowed(recipe.Type)
 }
 
 func (crafter *Crafter) calculateProfitMargin(recipe Recipe) (float64, error) {
@@ -124,7 +289,7 @@ func (crafter *Crafter) calculateProfitMargin(recipe Recipe) (float64, error) {
 		return 0, err
 	}
 	// Assuming we are selling it on TP
-	return (float64(recipeOutputPrice) * 0.85) / float64(recipeCost), nil
+	return (float64(recipeOutputPrice) * tradingPostFeeMultiplier) / float64(recipeCost), nil
 }
 
 func (crafter *Crafter) FindProfitableOptions(itemID int, depth int) ([]RecipeProfit, error) {
@@ -153,7 +318,11 @@ func (crafter *Crafter) FindProfitableOptions(itemID int, depth int) ([]RecipePr
 			continue
 		}
 		logger.Debug("Recipe is profitable", "recipeID", recipe.ID, "profitMargin", profitMargin)
-		profitableRecipes = append(profitableRecipes, RecipeProfit{RecipeID: recipe.ID, OutputItemID: recipe.OutputItemID, ProfitMargin: profitMargin})
+		recipeProfit, err := crafter.newRecipeProfit(recipe, profitMargin)
+		if err != nil {
+			return nil, err
+		}
+		profitableRecipes = append(profitableRecipes, recipeProfit)
 
 		subRecipes, err := crafter.FindProfitableOptions(recipe.OutputItemID, depth-1)
 		if err != nil {
@@ -1,22 +1,65 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
-	"github.com/jmoiron/sqlx"
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
 )
 
 func TestFindProfitableOptions(t *testing.T) {
-	db, err := sqlx.Connect("sqlite3", ":memory:")
+	db, cleanup := setupDB(t)
+	defer cleanup()
+
+	recipes := []Recipe{
+		{ID: 1, Type: "Refinement", OutputItemID: 100, OutputItemCount: 1, Ingredients: []Ingredient{{ItemID: 10, Count: 2}}},
+		{ID: 2, Type: "Refinement", OutputItemID: 200, OutputItemCount: 1, Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+		{ID: 3, Type: "Refinement", OutputItemID: 300, OutputItemCount: 1, Flags: StringSlice{"AutoLearned"}, Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+		{ID: 4, Type: "Component", OutputItemID: 400, OutputItemCount: 1, Flags: StringSlice{"AutoLearned"}, Ingredients: []Ingredient{{ItemID: 100, Count: 1}}},
+	}
+	if err := updateRecipeCache(db, recipes); err != nil {
+		t.Fatalf("Failed to update recipe cache: %v", err)
+	}
+	if err := updateTradeableItemsCache(db, []int{10, 100, 200, 300, 400}); err != nil {
+		t.Fatalf("Failed to update tradeable items cache: %v", err)
+	}
+
+	fake := fakeapi.New()
+	fake.SetAccountRecipes(1)
+	err := fake.AddPrices(
+		ItemPrice{ID: 10, Buys: TradingPostPrice{UnitPrice: 100}, Sells: TradingPostPrice{UnitPrice: 120}},
+		ItemPrice{ID: 100, Buys: TradingPostPrice{UnitPrice: 300}, Sells: TradingPostPrice{UnitPrice: 400}},
+		ItemPrice{ID: 200, Buys: TradingPostPrice{UnitPrice: 300}, Sells: TradingPostPrice{UnitPrice: 400}},
+		ItemPrice{ID: 300, Buys: TradingPostPrice{UnitPrice: 50}, Sells: TradingPostPrice{UnitPrice: 100}},
+		ItemPrice{ID: 400, Buys: TradingPostPrice{UnitPrice: 500}, Sells: TradingPostPrice{UnitPrice: 700}},
+	)
 	if err != nil {
-		t.Fatal(err)
+		t.Fatalf("Failed to seed fake API: %v", err)
 	}
-	defer db.Close()
-	apiClient := NewAPIClient("localhost", "token")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	apiClient := NewAPIClient(server.URL, "token")
 	localCache := NewLocalCache(db)
 
 	crafter := NewCrafter(*apiClient, *localCache)
 
+	previousThreshold := configObj.ProfitThreshold
+	configObj.ProfitThreshold = 1.0
+	defer func() { configObj.ProfitThreshold = previousThreshold }()
+
+	// Recipe 2 is not learned and recipe 3 sells below its cost
+	sellingItem100 := RecipeProfit{RecipeID: 1, OutputItemID: 100, ProfitMargin: 400 * 0.85 / 200}
+	refiningItem100 := RecipeProfit{RecipeID: 4, OutputItemID: 400, ProfitMargin: 700 * 0.85 / 300}
+
 	tests := []struct {
 		name    string
 		itemID  int
@@ -26,6 +69,9 @@ func TestFindProfitableOptions(t *testing.T) {
 	}{
 		{name: "Depth 0 returns nothing", itemID: 0, depth: 0, wantErr: false, want: nil},
 		{name: "Negative Depth returns error", itemID: 0, depth: -1, wantErr: true, want: nil},
+		{name: "Depth 1 returns profitable known recipes", itemID: 10, depth: 1, wantErr: false, want: []RecipeProfit{sellingItem100}},
+		{name: "Depth 2 includes recipes using profitable outputs", itemID: 10, depth: 2, wantErr: false, want: []RecipeProfit{refiningItem100, sellingItem100}},
+		{name: "Unused ingredient returns nothing", itemID: 999, depth: 1, wantErr: false, want: nil},
 	}
 
 	for _, tt := range tests {
@@ -35,10 +81,287 @@ func TestFindProfitableOptions(t *testing.T) {
 				t.Errorf("FindProfitableOptions() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if profitableOptions != nil {
-				t.Errorf("FindProfitableOptions() returned %v when nil was expected", profitableOptions)
+			if len(profitableOptions) != len(tt.want) {
+				t.Fatalf("FindProfitableOptions() returned %v, want %v", profitableOptions, tt.want)
+			}
+			for i, option := range profitableOptions {
+				want := tt.want[i]
+				if option.RecipeID != want.RecipeID || option.OutputItemID != want.OutputItemID || math.Abs(option.ProfitMargin-want.ProfitMargin) > 1e-9 {
+					t.Errorf("FindProfitableOptions()[%d] = %+v, want %+v", i, option, want)
+				}
+			}
+		})
+	}
+
+}
+
+func TestFetchItemTPPriceFromGemStore(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/commerce/exchange/coins":
+			w.Write([]byte(`{"coins_per_gem": 2500, "quantity": 400}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	db.SetMaxOpenConns(1)
+
+	currencies := []Currency{{ID: 1, Name: "Coin"}, {ID: 4, Name: "Gem"}}
+	if err := updateCurrencyCache(db, currencies); err != nil {
+		t.Fatalf("Failed to update currency cache: %v", err)
+	}
+	merchants := []Merchant{{
+		Name:      "Gem Store",
+		Locations: StringSlice{"Black Lion Trading Company"},
+		PurchaseOptions: []MerchantOptions{
+			{Type: "Item", ID: 100, Count: 5, Price: []MerchantPrice{{Type: "Currency", ID: 4, Count: 100}}},
+			// Cheaper in coin, but also costs other currencies and items
+			{Type: "Item", ID: 100, Count: 1, Price: []MerchantPrice{{Type: "Currency", ID: 1, Count: 20000}, {Type: "Currency", ID: 26, Count: 175}}},
+			// Priced in the item with ID 1, not in coin
+			{Type: "Item", ID: 200, Count: 1, Price: []MerchantPrice{{Type: "Item", ID: 1, Count: 3}}},
+		},
+	}}
+	if _, err := importMerchantData(db, merchants); err != nil {
+		t.Fatalf("Failed to update merchant cache: %v", err)
+	}
+
+	crafter := NewCrafter(*NewAPIClient(server.URL, "token"), *NewLocalCache(db))
+
+	itemPrice, err := crafter.fetchItemTPPrice(100)
+	if err != nil {
+		t.Fatalf("fetchItemTPPrice() returned error: %v", err)
+	}
+	// 100 gems for 5 items at 2500 coins per gem
+	if itemPrice.Buys.UnitPrice != 50000 {
+		t.Errorf("fetchItemTPPrice() buy price = %d, want 50000", itemPrice.Buys.UnitPrice)
+	}
+
+	_, err = crafter.fetchItemTPPrice(200)
+	var noOptionsErr *NoPurchasingOptionsFoundError
+	if !errors.As(err, &noOptionsErr) {
+		t.Errorf("fetchItemTPPrice() error = %v, want NoPurchasingOptionsFoundError", err)
+	}
+}
+
+func TestFindProfitableOptionsDailyCrafting(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	db.SetMaxOpenConns(1)
+
+	recipes := []Recipe{
+		{ID: 1, Type: "Refinement", OutputItemID: 46742, OutputItemCount: 1, Flags: StringSlice{"AutoLearned"}, Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+		{ID: 2, Type: "Refinement", OutputItemID: 46745, OutputItemCount: 1, Flags: StringSlice{"AutoLearned"}, Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+		{ID: 3, Type: "Refinement", OutputItemID: 19700, OutputItemCount: 1, Flags: StringSlice{"AutoLearned"}, Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+	}
+	items := []Item{
+		{ID: 46742, Name: "Lump of Mithrillium"},
+		{ID: 46745, Name: "Spool of Thick Elonian Cord"},
+		{ID: 19700, Name: "Mithril Ore"},
+	}
+	if err := updateRecipeCache(db, recipes); err != nil {
+		t.Fatalf("Failed to update recipe cache: %v", err)
+	}
+	if err := updateItemCache(db, items); err != nil {
+		t.Fatalf("Failed to update item cache: %v", err)
+	}
+	if err := updateTradeableItemsCache(db, []int{10, 46742, 46745, 19700}); err != nil {
+		t.Fatalf("Failed to update tradeable items cache: %v", err)
+	}
+	if err := updateDailyCraftingCache(db, []string{"lump_of_mithrillium", "spool_of_thick_elonian_cord"}); err != nil {
+		t.Fatalf("Failed to update daily crafting cache: %v", err)
+	}
+
+	fake := fakeapi.New()
+	fake.SetAccountDailyCrafting("lump_of_mithrillium")
+	err := fake.AddPrices(
+		ItemPrice{ID: 10, Buys: TradingPostPrice{UnitPrice: 100}},
+		ItemPrice{ID: 46742, Sells: TradingPostPrice{UnitPrice: 1000}},
+		ItemPrice{ID: 46745, Sells: TradingPostPrice{UnitPrice: 900}},
+		ItemPrice{ID: 19700, Sells: TradingPostPrice{UnitPrice: 800}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to seed fake API: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		forbidden bool // the API key lacks the progression scope
+		want      map[int]RecipeProfit
+	}{
+		{
+			name: "Daily crafting known",
+			want: map[int]RecipeProfit{
+				1: {DailyLimited: true, DailyCraftUsed: true, MaxCrafts: 0},
+				2: {DailyLimited: true, DailyCraftUsed: false, MaxCrafts: 1},
+				3: {DailyLimited: false, DailyCraftUsed: false, MaxCrafts: -1},
+			},
+		},
+		{
+			name:      "Daily crafting forbidden",
+			forbidden: true,
+			want: map[int]RecipeProfit{
+				1: {DailyLimited: true, DailyCraftUnknown: true, MaxCrafts: 1},
+				2: {DailyLimited: true, DailyCraftUnknown: true, MaxCrafts: 1},
+				3: {DailyLimited: false, DailyCraftUsed: false, MaxCrafts: -1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.forbidden && r.URL.Path == "/account/dailycrafting" {
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte(`{"text":"requires scope progression"}`))
+					return
+				}
+				fake.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			crafter := NewCrafter(*NewAPIClient(server.URL, "token"), *NewLocalCache(db))
+			profitableOptions, err := crafter.FindProfitableOptions(10, 1)
+			if err != nil {
+				t.Fatalf("FindProfitableOptions() returned error: %v", err)
+			}
+			if len(profitableOptions) != len(tt.want) {
+				t.Fatalf("FindProfitableOptions() returned %+v, want %d recipes", profitableOptions, len(tt.want))
+			}
+			for _, option := range profitableOptions {
+				w := tt.want[option.RecipeID]
+				if option.DailyLimited != w.DailyLimited || option.DailyCraftUsed != w.DailyCraftUsed || option.DailyCraftUnknown != w.DailyCraftUnknown || option.MaxCrafts != w.MaxCrafts {
+					t.Errorf("Recipe %d daily status = %+v, want %+v", option.RecipeID, option, w)
+				}
 			}
 		})
 	}
+}
+
+func TestCraftsFromStorageRemembersFailure(t *testing.T) {
+	var materialRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/account/materials" {
+			materialRequests++
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"text":"requires scope inventories"}`))
+	}))
+	defer server.Close()
 
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	crafter := NewCrafter(*NewAPIClient(server.URL, "token"), *NewLocalCache(db))
+	recipes := []Recipe{
+		{ID: 1, Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+		{ID: 2, Ingredients: []Ingredient{{ItemID: 20, Count: 1}}},
+	}
+	for _, recipe := range recipes {
+		if _, err := crafter.craftsFromStorage(recipe); err == nil {
+			t.Errorf("craftsFromStorage(%d) returned no error for a forbidden material storage", recipe.ID)
+		}
+	}
+	if materialRequests != 1 {
+		t.Errorf("Material storage was requested %d times, want 1", materialRequests)
+	}
+}
+
+// recordFixtures re-records the replay fixtures from the live API:
+//
+//	GW2_API_KEY=... go test -run TestFindProfitableOptionsReplay -record-fixtures
+var recordFixtures = flag.Bool("record-fixtures", false, "Record replay fixtures from the live GW2 API and update the expected results")
+
+const (
+	replayFixtureDir   = "testdata/crafter_replay"
+	replayExpectedFile = "testdata/crafter_replay_profits.json"
+)
+
+// runReplayScenario scans Mithril Ore two recipes deep, with the account and
+// price requests going through transport
+func runReplayScenario(t *testing.T, transport http.RoundTripper, apiKey string) []RecipeProfit {
+	t.Helper()
+	db, cleanup := setupDB(t)
+	t.Cleanup(cleanup)
+
+	recipes := []Recipe{
+		{ID: 1, Type: "Refinement", OutputItemID: 19684, OutputItemCount: 1, Disciplines: StringSlice{"Armorsmith", "Weaponsmith"}, Flags: StringSlice{"AutoLearned"},
+			Ingredients: []Ingredient{{ItemID: 19700, Count: 2}}},
+		{ID: 2, Type: "Refinement", OutputItemID: 46742, OutputItemCount: 1, Disciplines: StringSlice{"Armorsmith", "Weaponsmith"}, MinRating: 450,
+			Ingredients: []Ingredient{{ItemID: 19684, Count: 10}, {ItemID: 19721, Count: 1}}},
+	}
+	if err := updateRecipeCache(db, recipes); err != nil {
+		t.Fatalf("Failed to update recipe cache: %v", err)
+	}
+	if err := updateTradeableItemsCache(db, []int{19700, 19684, 19721, 46742}); err != nil {
+		t.Fatalf("Failed to update tradeable items cache: %v", err)
+	}
+	items := []Item{
+		{ID: 19700, Name: "Mithril Ore"},
+		{ID: 19684, Name: "Mithril Ingot"},
+		{ID: 19721, Name: "Glob of Ectoplasm"},
+		{ID: 46742, Name: "Lump of Mithrillium"},
+	}
+	if err := updateItemCache(db, items); err != nil {
+		t.Fatalf("Failed to update item cache: %v", err)
+	}
+	if err := updateDailyCraftingCache(db, []string{"lump_of_mithrillium"}); err != nil {
+		t.Fatalf("Failed to update daily crafting cache: %v", err)
+	}
+
+	previousThreshold := configObj.ProfitThreshold
+	configObj.ProfitThreshold = 1.0
+	t.Cleanup(func() { configObj.ProfitThreshold = previousThreshold })
+
+	client := NewAPIClient("https://api.guildwars2.com/v2", apiKey, WithTransport(transport))
+	crafter := NewCrafter(*client, *NewLocalCache(db))
+	profitableOptions, err := crafter.FindProfitableOptions(19700, 2)
+	if err != nil {
+		t.Fatalf("FindProfitableOptions() returned error: %v", err)
+	}
+	return profitableOptions
+}
+
+func TestFindProfitableOptionsReplay(t *testing.T) {
+	if *recordFixtures {
+		apiKey := os.Getenv("GW2_API_KEY")
+		if apiKey == "" {
+			t.Fatal("GW2_API_KEY is required to record fixtures")
+		}
+		if err := os.RemoveAll(replayFixtureDir); err != nil {
+			t.Fatal(err)
+		}
+		recorder, err := NewRecordingTransport(replayFixtureDir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.MarshalIndent(runReplayScenario(t, recorder, apiKey), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(replayExpectedFile, append(data, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want []RecipeProfit
+	data, err := os.ReadFile(filepath.Clean(replayExpectedFile))
+	if err != nil {
+		t.Fatalf("Failed to read expected profits: %v", err)
+	}
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatalf("Failed to parse expected profits: %v", err)
+	}
+	if len(want) == 0 {
+		t.Fatalf("%s has no profitable recipes, the scenario no longer covers anything", replayExpectedFile)
+	}
+
+	replayer, err := NewReplayTransport(replayFixtureDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runReplayScenario(t, replayer, "token"); !reflect.DeepEqual(got, want) {
+		t.Errorf("FindProfitableOptions() replayed = %+v, want %+v", got, want)
+	}
 }
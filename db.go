@@ -4,19 +4,31 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 type LocalCache struct {
-	db *sqlx.DB
+	db      *sqlx.DB
+	recipes *RecipeGraph // serves recipe lookups once loaded by LoadRecipeGraph
+	prices  *priceStore  // item prices shared by every crafter using this cache
 }
 
 func NewLocalCache(db *sqlx.DB) *LocalCache {
-	return &LocalCache{db: db}
+	return &LocalCache{db: db, prices: newPriceStore(defaultPriceTTL)}
 }
 
 func (lc *LocalCache) GetRecipeById(recipeID int) (*Recipe, error) {
+	if lc.recipes != nil {
+		recipe := lc.recipes.Recipe(recipeID)
+		if recipe == nil {
+			return nil, errors.New("Recipe not found")
+		}
+		return recipe, nil
+	}
 	var recipe Recipe
 	err := lc.db.Get(&recipe, "SELECT * FROM recipes WHERE id = ?", recipeID)
 	if err != nil {
@@ -26,17 +38,92 @@ func (lc *LocalCache) GetRecipeById(recipeID int) (*Recipe, error) {
 		return nil, err
 	}
 
-	var ingredients []Ingredient
-	err = lc.db.Select(&ingredients, "SELECT * FROM ingredients WHERE recipe_id = ?", recipeID)
+	err = lc.loadAllIngredients(&recipe)
 	if err != nil {
 		return nil, err
 	}
+
+	return &recipe, nil
+}
+
+// loadAllIngredients loads both the item and guild ingredients of a recipe
+func (lc *LocalCache) loadAllIngredients(recipe *Recipe) error {
+	var ingredients []Ingredient
+	err := lc.db.Select(&ingredients, "SELECT * FROM ingredients WHERE recipe_id = ?", recipe.ID)
+	if err != nil {
+		return err
+	}
 	recipe.Ingredients = ingredients
 
+	var guildIngredients []GuildIngredient
+	err = lc.db.Select(&guildIngredients, "SELECT * FROM guild_ingredients WHERE recipe_id = ?", recipe.ID)
+	if err != nil {
+		return err
+	}
+	recipe.GuildIngredients = guildIngredients
+	return nil
+}
+
+// GetRecipeByOutputUpgrade returns the recipe producing a guild upgrade, or nil when there is none
+func (lc *LocalCache) GetRecipeByOutputUpgrade(upgradeID int) (*Recipe, error) {
+	if lc.recipes != nil {
+		return lc.recipes.RecipeProducingUpgrade(upgradeID), nil
+	}
+	var recipe Recipe
+	err := lc.db.Get(&recipe, "SELECT * FROM recipes WHERE output_upgrade_id = ? LIMIT 1", upgradeID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	err = lc.loadAllIngredients(&recipe)
+	if err != nil {
+		return nil, err
+	}
 	return &recipe, nil
 }
 
+// GetGuildDecorationRecipes returns the Scribe recipes producing guild decorations
+func (lc *LocalCache) GetGuildDecorationRecipes() ([]Recipe, error) {
+	var recipes []Recipe
+	err := lc.db.Select(&recipes, `
+		SELECT r.* FROM recipes r
+		INNER JOIN guild_upgrades gu ON gu.id = r.output_upgrade_id
+		WHERE gu.type = 'Decoration' AND (',' || r.disciplines || ',') LIKE '%,Scribe,%'
+		ORDER BY r.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	for i := range recipes {
+		if err := lc.loadAllIngredients(&recipes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return recipes, nil
+}
+
+func (lc *LocalCache) GetGuildUpgradeById(upgradeID int) (*GuildUpgrade, error) {
+	var upgrade GuildUpgrade
+	err := lc.db.Get(&upgrade, "SELECT id, name, description, type, required_level FROM guild_upgrades WHERE id = ?", upgradeID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("Guild upgrade not found")
+		}
+		return nil, err
+	}
+	err = lc.db.Select(&upgrade.Costs, "SELECT type, name, count, item_id FROM guild_upgrade_costs WHERE upgrade_id = ?", upgradeID)
+	if err != nil {
+		return nil, err
+	}
+	return &upgrade, nil
+}
+
 func (lc *LocalCache) GetRecipeByIngredient(ingredientID int) ([]Recipe, error) {
+	if lc.recipes != nil {
+		return lc.recipes.RecipesConsuming(ingredientID), nil
+	}
 	var recipes []Recipe
 	err := lc.db.Select(&recipes, `
 		SELECT r.* FROM recipes r
@@ -62,6 +149,61 @@ func (lc *LocalCache) GetRecipeByIngredient(ingredientID int) ([]Recipe, error)
 	return recipes, nil
 }
 
+func (lc *LocalCache) GetRecipesByOutput(outputItemID int) ([]Recipe, error) {
+	if lc.recipes != nil {
+		return lc.recipes.RecipesProducing(outputItemID), nil
+	}
+	var recipes []Recipe
+	err := lc.db.Select(&recipes, "SELECT * FROM recipes WHERE output_item_id = ?", outputItemID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range recipes {
+		var ingredients []Ingredient
+		err = lc.db.Select(&ingredients, "SELECT * FROM ingredients WHERE recipe_id = ?", recipes[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		recipes[i].Ingredients = ingredients
+	}
+
+	return recipes, nil
+}
+
+// GetMaterialCategoryItems returns the item IDs stored under a material storage
+// category, matching its name case-insensitively
+func (lc *LocalCache) GetMaterialCategoryItems(categoryName string) ([]int, error) {
+	var categoryID int
+	err := lc.db.Get(&categoryID, "SELECT id FROM material_categories WHERE name = ? COLLATE NOCASE", categoryName)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("Material category %q not found", categoryName)
+		}
+		return nil, err
+	}
+	var itemIDs []int
+	err = lc.db.Select(&itemIDs, "SELECT item_id FROM material_category_items WHERE category_id = ? ORDER BY item_id", categoryID)
+	if err != nil {
+		return nil, err
+	}
+	return itemIDs, nil
+}
+
+// GetDailyCraftingID returns the daily crafting ID of a time-gated recipe, or an
+// empty string when the recipe can be crafted without limits
+func (lc *LocalCache) GetDailyCraftingID(recipeID int) (string, error) {
+	var dailyID string
+	err := lc.db.Get(&dailyID, "SELECT daily_id FROM daily_crafting WHERE recipe_id = ?", recipeID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return dailyID, nil
+}
+
 func (lc *LocalCache) GetItemById(itemID int) (*Item, error) {
 	var item Item
 	err := lc.db.Get(&item, "SELECT * FROM items WHERE id = ?", itemID)
@@ -74,6 +216,69 @@ func (lc *LocalCache) GetItemById(itemID int) (*Item, error) {
 	return &item, nil
 }
 
+// An ItemFilter restricts FindItems results. Zero values are ignored.
+type ItemFilter struct {
+	Type        string // Item type, e.g. "Armor"
+	Rarity      string
+	MinLevel    int
+	MaxLevel    int
+	DetailsType string // Item subtype from details, e.g. "Coat"
+	WeightClass string // Armor weight class, e.g. "Heavy"
+	StatChoice  int    // Itemstat ID that must be among the stat choices
+	Restriction string // Race or profession restriction, e.g. "Asura"
+}
+
+// FindItems returns the cached items matching every field set in the filter, ordered by ID
+func (lc *LocalCache) FindItems(filter ItemFilter) ([]Item, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Type != "" {
+		conditions = append(conditions, "type = ?")
+		args = append(args, filter.Type)
+	}
+	if filter.Rarity != "" {
+		conditions = append(conditions, "rarity = ?")
+		args = append(args, filter.Rarity)
+	}
+	if filter.MinLevel > 0 {
+		conditions = append(conditions, "level >= ?")
+		args = append(args, filter.MinLevel)
+	}
+	if filter.MaxLevel > 0 {
+		conditions = append(conditions, "level <= ?")
+		args = append(args, filter.MaxLevel)
+	}
+	if filter.DetailsType != "" {
+		conditions = append(conditions, "json_extract(details, '$.type') = ?")
+		args = append(args, filter.DetailsType)
+	}
+	if filter.WeightClass != "" {
+		conditions = append(conditions, "json_extract(details, '$.weight_class') = ?")
+		args = append(args, filter.WeightClass)
+	}
+	if filter.StatChoice > 0 {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(details, '$.stat_choices') WHERE value = ?)")
+		args = append(args, filter.StatChoice)
+	}
+	if filter.Restriction != "" {
+		conditions = append(conditions, "(',' || restrictions || ',') LIKE ? ESCAPE '\\'")
+		args = append(args, "%,"+escapeLike(filter.Restriction)+",%")
+	}
+
+	query := "SELECT * FROM items"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id"
+
+	var items []Item
+	err := lc.db.Select(&items, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 func (lc *LocalCache) ItemIsTradeable(itemID int) (bool, error) {
 	var id int
 	query := "SELECT EXISTS(SELECT 1 FROM tradeable_items WHERE id = ?)"
@@ -99,39 +304,40 @@ func (lc *LocalCache) GetCurrencyIDByName(currencyName string) (int, error) {
 	return id, nil
 }
 
-func (lc *LocalCache) HasPurchaseOptionWithCurrency(itemId int, currencyName string) (bool, error) {
-	currencyId, err := lc.GetCurrencyIDByName(currencyName)
-	if err != nil {
-		return false, err
-	}
+// HasPurchaseOptionWithCurrency reports whether a merchant sells the item for
+// the given currency alone. Offerings that also cost other currencies or items
+// are not considered, since their price cannot be expressed in one currency.
+func (lc *LocalCache) HasPurchaseOptionWithCurrency(itemId int, currencyId int) (bool, error) {
 	var count int
-	err = lc.db.QueryRowx(`SELECT COUNT(*) FROM purchase_options po
+	err := lc.db.QueryRowx(`SELECT COUNT(*) FROM purchase_options po
                            JOIN merchant_prices mp ON po.id = mp.purchase_option_id
-                           WHERE po.item_id = ? AND mp.currency_id = ? AND po.ignore = 0`, itemId, currencyId).Scan(&count)
+                           WHERE po.item_id = ? AND mp.type = 'Currency' AND mp.currency_id = ? AND po.ignore = 0
+                           AND NOT EXISTS (SELECT 1 FROM merchant_prices other
+                                           WHERE other.purchase_option_id = po.id AND other.id != mp.id)`, itemId, currencyId).Scan(&count)
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
-func (lc *LocalCache) GetMerchantItemPrice(itemID int, currencyName string) (*ItemPrice, error) {
-	currencyId, err := lc.GetCurrencyIDByName(currencyName)
+// GetMerchantItemPrice returns the cheapest unit price for an item among the
+// merchant offerings priced in the given currency alone
+func (lc *LocalCache) GetMerchantItemPrice(itemID int, currencyId int) (*ItemPrice, error) {
+	var unitPrice sql.NullFloat64
+	err := lc.db.QueryRowx(
+		`SELECT MIN(CAST(mp.count AS REAL) / po.count) FROM merchant_prices mp
+    JOIN purchase_options po ON mp.purchase_option_id = po.id
+    WHERE po.item_id = ? AND mp.type = 'Currency' AND mp.currency_id = ? AND po.ignore = 0
+    AND NOT EXISTS (SELECT 1 FROM merchant_prices other WHERE other.purchase_option_id = po.id AND other.id != mp.id)`, itemID, currencyId).Scan(&unitPrice)
 	if err != nil {
-		return nil, err
-	}
-	var currencyPrice int
-	err = lc.db.QueryRowx(
-		`SELECT mp.count FROM merchant_prices merchant_prices
-    JOIN purchase_options po ON mp.purchase_option_id = po.recipe_id
-    WHERE po.item_id = ? AND mp.currency_id = ?`, itemID, currencyId).Scan(&currencyPrice)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// No price was found with given currency
-			return nil, fmt.Errorf("No price found in %s for itemID %d", currencyName, itemID)
-		}
 		// An error has occurred during the query
 		return nil, err
 	}
+	if !unitPrice.Valid {
+		// No price was found with given currency
+		return nil, fmt.Errorf("No price found in currency %d for itemID %d", currencyId, itemID)
+	}
+	currencyPrice := int(math.Ceil(unitPrice.Float64))
 	// Price found, return a custom ItemPrice
 	return &ItemPrice{
 		ID:    itemID,
@@ -139,3 +345,18 @@ func (lc *LocalCache) GetMerchantItemPrice(itemID int, currencyName string) (*It
 		Sells: TradingPostPrice{UnitPrice: currencyPrice},
 	}, nil
 }
+
+// GetTransactions returns the fulfilled transactions on the given side that
+// were purchased within [since, until)
+func (lc *LocalCache) GetTransactions(side TransactionSide, since, until time.Time) ([]Transaction, error) {
+	var transactions []Transaction
+	err := lc.db.Select(&transactions, `
+		SELECT id, side, item_id, price, quantity, created, purchased FROM transactions
+		WHERE side = ? AND purchased >= ? AND purchased < ?
+		ORDER BY purchased
+	`, side, since.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return transactions, nil
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
 )
 
-func setupDB(t *testing.T) (*sqlx.DB, func()) {
-	db, err := sqlx.Connect("sqlite3", ":memory:")
+func setupDB(t testing.TB) (*sqlx.DB, func()) {
+	db, err := OpenCache(InMemoryCache)
 	if err != nil {
 		t.Fatalf("Failed to create mock database: %v", err)
 	}
@@ -75,3 +78,113 @@ func TestGetCurrencyIdByName(t *testing.T) {
 		})
 	}
 }
+
+func TestFindItems(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	db.SetMaxOpenConns(1)
+
+	itemsJSON := `[
+		{"id": 1, "name": "Heavy Coat", "type": "Armor", "rarity": "Exotic", "level": 80, "restrictions": [],
+		 "details": {"type": "Coat", "weight_class": "Heavy", "defense": 363, "stat_choices": [656, 1153]},
+		 "upgrades_into": [{"upgrade": "Infusion", "item_id": 4}]},
+		{"id": 2, "name": "Light Coat", "type": "Armor", "rarity": "Exotic", "level": 80,
+		 "details": {"type": "Coat", "weight_class": "Light", "defense": 314}},
+		{"id": 3, "name": "Asuran Helm", "type": "Armor", "rarity": "Rare", "level": 60, "restrictions": ["Asura"],
+		 "details": {"type": "Helm", "weight_class": "Heavy"}}
+	]`
+	var items []Item
+	if err := json.Unmarshal([]byte(itemsJSON), &items); err != nil {
+		t.Fatalf("Failed to decode items: %v", err)
+	}
+	if err := updateItemCache(db, items); err != nil {
+		t.Fatalf("Failed to update item cache: %v", err)
+	}
+	lc := NewLocalCache(db)
+
+	testCases := []struct {
+		name   string
+		filter ItemFilter
+		want   []int
+	}{
+		{"No filter returns everything", ItemFilter{}, []int{1, 2, 3}},
+		{"Level 80 exotic heavy armor", ItemFilter{Type: "Armor", Rarity: "Exotic", MinLevel: 80, MaxLevel: 80, WeightClass: "Heavy"}, []int{1}},
+		{"Subtype", ItemFilter{DetailsType: "Coat"}, []int{1, 2}},
+		{"Stat choice", ItemFilter{StatChoice: 1153}, []int{1}},
+		{"Restriction", ItemFilter{Restriction: "Asura"}, []int{3}},
+		{"Restriction wildcards are literal", ItemFilter{Restriction: "A%"}, nil},
+		{"Level range", ItemFilter{MaxLevel: 70}, []int{3}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			found, err := lc.FindItems(tc.filter)
+			if err != nil {
+				t.Fatalf("FindItems() returned error: %v", err)
+			}
+			var ids []int
+			for _, item := range found {
+				ids = append(ids, item.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.want) {
+				t.Errorf("FindItems() returned ids %v, want %v", ids, tc.want)
+			}
+		})
+	}
+
+	item, err := lc.GetItemById(1)
+	if err != nil {
+		t.Fatalf("GetItemById() returned error: %v", err)
+	}
+	if item.Level != 80 || item.Details.WeightClass != "Heavy" || !reflect.DeepEqual(item.Details.StatChoices, []int{656, 1153}) || len(item.UpgradesInto) != 1 || item.UpgradesInto[0].ItemID != 4 || len(item.Restrictions) != 0 {
+		t.Errorf("GetItemById() returned %+v, want full item details", item)
+	}
+	details, _ := json.Marshal(item.Details)
+	if !strings.Contains(string(details), `"defense":363`) {
+		t.Errorf("Stored details %s lost fields that are not decoded", details)
+	}
+}
+
+func TestGetMaterialCategoryItems(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	db.SetMaxOpenConns(1)
+
+	categories := []MaterialCategory{
+		{ID: 5, Name: "Common Crafting Materials", Items: []int{19718, 19697}, Order: 0},
+		{ID: 6, Name: "Cooking Ingredients", Items: []int{12134, 12238}, Order: 10},
+	}
+	// Refreshing twice must not duplicate items
+	for i := 0; i < 2; i++ {
+		if err := updateMaterialCategoryCache(db, categories); err != nil {
+			t.Fatalf("Failed to update material category cache: %v", err)
+		}
+	}
+	lc := NewLocalCache(db)
+
+	testCases := []struct {
+		name           string
+		categoryName   string
+		want           []int
+		expectedErrStr string
+	}{
+		{"Exact name", "Common Crafting Materials", []int{19697, 19718}, ""},
+		{"Name is case insensitive", "cooking ingredients", []int{12134, 12238}, ""},
+		{"Unknown category", "Gemstones", nil, `Material category "Gemstones" not found`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			itemIDs, err := lc.GetMaterialCategoryItems(tc.categoryName)
+			if err != nil {
+				if err.Error() != tc.expectedErrStr {
+					t.Fatalf("Unexpected error: got %v, want %v", err.Error(), tc.expectedErrStr)
+				}
+				return
+			}
+			if !reflect.DeepEqual(itemIDs, tc.want) {
+				t.Errorf("GetMaterialCategoryItems() = %v, want %v", itemIDs, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// GuildRecipeCost values the tradable inputs of a guild recipe, following guild
+// ingredients into the recipes of the upgrades they consume. Inputs that cannot
+// be valued are listed on the result rather than failing the whole recipe.
+func (crafter *Crafter) GuildRecipeCost(recipe Recipe) (*GuildRecipeCost, error) {
+	cost := &GuildRecipeCost{RecipeID: recipe.ID, OutputUpgradeID: recipe.OutputUpgradeID}
+	err := crafter.addGuildRecipeCost(recipe, 1, cost, map[int]bool{})
+	if err != nil {
+		return nil, err
+	}
+	return cost, nil
+}
+
+func (crafter *Crafter) addGuildRecipeCost(recipe Recipe, crafts int, cost *GuildRecipeCost, visiting map[int]bool) error {
+	if visiting[recipe.ID] {
+		return fmt.Errorf("Guild recipe %d depends on itself", recipe.ID)
+	}
+	visiting[recipe.ID] = true
+	defer delete(visiting, recipe.ID)
+
+	for _, ingredient := range recipe.Ingredients {
+		itemPrice, err := crafter.findItemBuyValue(ingredient.ItemID)
+		if err != nil {
+			var noOptions *NoPurchasingOptionsFoundError
+			if errors.As(err, &noOptions) {
+				if !slices.Contains(cost.UntradableIngredients, ingredient.ItemID) {
+					cost.UntradableIngredients = append(cost.UntradableIngredients, ingredient.ItemID)
+				}
+				continue
+			}
+			return fmt.Errorf("Failed to find item buy value: %w", err)
+		}
+		cost.Cost += itemPrice * ingredient.Count * crafts
+	}
+
+	for _, guildIngredient := range recipe.GuildIngredients {
+		upgradeRecipe, err := crafter.localCache.GetRecipeByOutputUpgrade(guildIngredient.UpgradeID)
+		if err != nil {
+			return err
+		}
+		if upgradeRecipe == nil {
+			if !slices.Contains(cost.UncraftableUpgrades, guildIngredient.UpgradeID) {
+				cost.UncraftableUpgrades = append(cost.UncraftableUpgrades, guildIngredient.UpgradeID)
+			}
+			continue
+		}
+		err = crafter.addGuildRecipeCost(*upgradeRecipe, crafts*guildIngredient.Count, cost, visiting)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScribeDecorationCosts values every Scribe guild decoration recipe, cheapest first
+func (crafter *Crafter) ScribeDecorationCosts() ([]GuildRecipeCost, error) {
+	recipes, err := crafter.localCache.GetGuildDecorationRecipes()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch guild decoration recipes: %w", err)
+	}
+	costs := make([]GuildRecipeCost, 0, len(recipes))
+	for _, recipe := range recipes {
+		cost, err := crafter.GuildRecipeCost(recipe)
+		if err != nil {
+			return nil, err
+		}
+		costs = append(costs, *cost)
+	}
+	sort.SliceStable(costs, func(i, j int) bool {
+		return costs[i].Cost < costs[j].Cost
+	})
+	return costs, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
+)
+
+func TestScribeDecorationCosts(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	db.SetMaxOpenConns(1)
+
+	recipes := []Recipe{
+		// Decoration needing 3 of upgrade 600, an untradable item and an uncraftable upgrade
+		{ID: 1, Type: "Refinement", OutputUpgradeID: 500, OutputItemCount: 1, Disciplines: StringSlice{"Scribe"},
+			Ingredients:      []Ingredient{{ItemID: 10, Count: 2}, {ItemID: 20, Count: 1}},
+			GuildIngredients: []GuildIngredient{{UpgradeID: 600, Count: 3}, {UpgradeID: 700, Count: 1}}},
+		{ID: 2, Type: "Refinement", OutputUpgradeID: 600, OutputItemCount: 1, Disciplines: StringSlice{"Scribe"},
+			Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+		{ID: 3, Type: "Refinement", OutputUpgradeID: 800, OutputItemCount: 1, Disciplines: StringSlice{"Scribe"},
+			Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+		// Not a Scribe recipe, so it is not reported even though it makes a decoration
+		{ID: 4, Type: "Refinement", OutputUpgradeID: 900, OutputItemCount: 1, Disciplines: StringSlice{"Chef"},
+			Ingredients: []Ingredient{{ItemID: 10, Count: 1}}},
+	}
+	if err := updateRecipeCache(db, recipes); err != nil {
+		t.Fatalf("Failed to update recipe cache: %v", err)
+	}
+	upgrades := []GuildUpgrade{
+		{ID: 500, Name: "Statue", Type: "Decoration"},
+		{ID: 600, Name: "Plank", Type: "Consumable"},
+		{ID: 700, Name: "Trophy", Type: "Decoration"},
+		{ID: 800, Name: "Banner", Type: "Decoration"},
+		{ID: 900, Name: "Feast", Type: "Decoration"},
+	}
+	if err := updateGuildUpgradeCache(db, upgrades); err != nil {
+		t.Fatalf("Failed to update guild upgrade cache: %v", err)
+	}
+	if err := updateCurrencyCache(db, []Currency{{ID: 1, Name: "Coin"}, {ID: 4, Name: "Gem"}}); err != nil {
+		t.Fatalf("Failed to update currency cache: %v", err)
+	}
+
+	fake := fakeapi.New()
+	if err := fake.AddPrices(ItemPrice{ID: 10, Buys: TradingPostPrice{UnitPrice: 100}}); err != nil {
+		t.Fatalf("Failed to seed prices: %v", err)
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	crafter := NewCrafter(*NewAPIClient(server.URL, "token"), *NewLocalCache(db))
+	costs, err := crafter.ScribeDecorationCosts()
+	if err != nil {
+		t.Fatalf("ScribeDecorationCosts() returned error: %v", err)
+	}
+
+	want := []GuildRecipeCost{
+		{RecipeID: 3, OutputUpgradeID: 800, Cost: 100},
+		// 2 of item 10 directly plus 3 crafts of upgrade 600
+		{RecipeID: 1, OutputUpgradeID: 500, Cost: 500, UntradableIngredients: []int{20}, UncraftableUpgrades: []int{700}},
+	}
+	if !reflect.DeepEqual(costs, want) {
+		t.Errorf("ScribeDecorationCosts() = %+v, want %+v", costs, want)
+	}
+}
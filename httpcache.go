@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultResponseCacheMaxAge caps how long responses are reused per endpoint family.
+// Trading Post data changes constantly, while static game data only changes on new builds.
+var DefaultResponseCacheMaxAge = map[string]time.Duration{
+	"/commerce":   5 * time.Minute,
+	"/account":    5 * time.Minute,
+	"/items":      24 * time.Hour,
+	"/recipes":    24 * time.Hour,
+	"/currencies": 24 * time.Hour,
+}
+
+// A ResponseCache stores successful API responses on disk, so repeated runs can
+// reuse them while fresh and revalidate them with conditional requests once stale
+type ResponseCache struct {
+	dir    string                   // directory holding one file per cached response
+	maxAge map[string]time.Duration // maximum freshness per endpoint prefix
+}
+
+type cachedResponse struct {
+	Endpoint     string          `json:"endpoint"`
+	ETag         string          `json:"etag,omitempty"`
+	LastModified string          `json:"last_modified,omitempty"`
+	Expires      time.Time       `json:"expires"`
+	Body         json.RawMessage `json:"body"`
+}
+
+func NewResponseCache(dir string, maxAge map[string]time.Duration) (*ResponseCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if maxAge == nil {
+		maxAge = DefaultResponseCacheMaxAge
+	}
+	return &ResponseCache{dir: dir, maxAge: maxAge}, nil
+}
+
+// key identifies a response by endpoint and token, since account endpoints
+// return different data per API key
+func (rc *ResponseCache) key(endpoint, authToken string) string {
+	hash := sha256.Sum256([]byte(authToken + "\n" + endpoint))
+	return hex.EncodeToString(hash[:])
+}
+
+func (rc *ResponseCache) path(key string) string {
+	return filepath.Join(rc.dir, key+".json")
+}
+
+func (rc *ResponseCache) load(key string) *cachedResponse {
+	data, err := os.ReadFile(rc.path(key))
+	if err != nil {
+		return nil
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil {
+		logger.Warn("Discarding unreadable cached response", "key", key, "error", err)
+		return nil
+	}
+	return &entry
+}
+
+func (rc *ResponseCache) store(key string, entry *cachedResponse) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so concurrent readers never see partial entries
+	tmpFile, err := os.CreateTemp(rc.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), rc.path(key))
+}
+
+// maxAgeFor returns the configured maximum age for the longest matching endpoint prefix
+func (rc *ResponseCache) maxAgeFor(endpoint string) (time.Duration, bool) {
+	bestPrefix := ""
+	var maxAge time.Duration
+	for prefix, age := range rc.maxAge {
+		if strings.HasPrefix(endpoint, prefix) && len(prefix) > len(bestPrefix) {
+			bestPrefix = prefix
+			maxAge = age
+		}
+	}
+	return maxAge, bestPrefix != ""
+}
+
+// cacheable reports whether the server allows the response to be stored
+func cacheable(header http.Header) bool {
+	return !strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-store")
+}
+
+// expiry calculates until when a response is fresh, using Cache-Control or Expires
+// from the server and capping it with the endpoint family's maximum age
+func (rc *ResponseCache) expiry(endpoint string, header http.Header, now time.Time) time.Time {
+	var expires time.Time
+	headerLifetime := false
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" {
+			return now
+		}
+		if seconds, found := strings.CutPrefix(directive, "max-age="); found {
+			if value, err := strconv.Atoi(seconds); err == nil {
+				expires = now.Add(time.Duration(value) * time.Second)
+				headerLifetime = true
+			}
+		}
+	}
+	if !headerLifetime {
+		if value, err := http.ParseTime(header.Get("Expires")); err == nil {
+			expires = value
+			headerLifetime = true
+		}
+	}
+
+	maxAge, configured := rc.maxAgeFor(endpoint)
+	switch {
+	case configured && (!headerLifetime || now.Add(maxAge).Before(expires)):
+		return now.Add(maxAge)
+	case headerLifetime:
+		return expires
+	default:
+		return now
+	}
+}
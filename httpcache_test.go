@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheRevalidatesWithETag(t *testing.T) {
+	requests, notModified := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(`{"id": 19718, "buys": {"quantity": 1, "unit_price": 10}, "sells": {"quantity": 1, "unit_price": 20}}`))
+	}))
+	defer server.Close()
+
+	// A zero max age forces every lookup to revalidate
+	responseCache, err := NewResponseCache(t.TempDir(), map[string]time.Duration{"/commerce": 0})
+	if err != nil {
+		t.Fatalf("NewResponseCache() returned error: %v", err)
+	}
+	client := NewAPIClient(server.URL, "token", WithResponseCache(responseCache))
+
+	for i := 0; i < 2; i++ {
+		itemPrice, err := client.FetchItemPrice(19718)
+		if err != nil {
+			t.Fatalf("FetchItemPrice() returned error: %v", err)
+		}
+		if itemPrice.Sells.UnitPrice != 20 {
+			t.Errorf("FetchItemPrice() sell price = %d, want 20", itemPrice.Sells.UnitPrice)
+		}
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("Got %d requests with %d revalidations, want 2 requests with 1 revalidation", requests, notModified)
+	}
+}
+
+func TestResponseCacheServesFreshResponses(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Write([]byte(`[1, 2, 3]`))
+	}))
+	defer server.Close()
+
+	responseCache, err := NewResponseCache(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("NewResponseCache() returned error: %v", err)
+	}
+	client := NewAPIClient(server.URL, "token", WithResponseCache(responseCache))
+
+	for i := 0; i < 3; i++ {
+		ids, err := client.FetchAllItemsIds()
+		if err != nil {
+			t.Fatalf("FetchAllItemsIds() returned error: %v", err)
+		}
+		if len(ids) != 3 {
+			t.Errorf("FetchAllItemsIds() returned %v, want 3 ids", ids)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Got %d requests, want 1", requests)
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	responseCache := &ResponseCache{maxAge: map[string]time.Duration{"/commerce": time.Minute, "/items": time.Hour}}
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		endpoint string
+		header   http.Header
+		want     time.Time
+	}{
+		{"Server max-age is capped by family max age", "/commerce/prices/1", http.Header{"Cache-Control": {"max-age=300"}}, now.Add(time.Minute)},
+		{"Shorter server max-age wins", "/items/1", http.Header{"Cache-Control": {"max-age=60"}}, now.Add(time.Minute)},
+		{"Expires is used without max-age", "/currencies", http.Header{"Expires": {now.Add(2 * time.Hour).Format(http.TimeFormat)}}, now.Add(2 * time.Hour)},
+		{"No-cache is always stale", "/items/1", http.Header{"Cache-Control": {"no-cache"}}, now},
+		{"Unknown family without headers is stale", "/build", http.Header{}, now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := responseCache.expiry(tt.endpoint, tt.header, now)
+			if !got.Equal(tt.want) {
+				t.Errorf("expiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
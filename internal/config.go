@@ -7,10 +7,47 @@ import (
 )
 
 type Config struct {
-	ApiKey          string   `json:"api_key"`
-	ProfitThreshold float64  `json:"profit_threshold"`
-	LogLevel        string   `json:"log_level"`
-	RemovedTypes    []string `json:"removed_types"`
+	ApiKey           string              `json:"api_key"`
+	ProfitThreshold  float64             `json:"profit_threshold"`
+	LogLevel         string              `json:"log_level"`
+	RemovedTypes     []string            `json:"removed_types"`
+	ResponseCache    ResponseCacheConfig `json:"response_cache"`
+	BuildSources     []string            `json:"build_sources"` // fallback order of "cdn", "api" and "pinned"
+	BuildCDNURL      string              `json:"build_cdn_url"`
+	PinnedBuild      int                 `json:"pinned_build"`
+	Accounts         []AccountConfig     `json:"accounts"`
+	TargetItems      []int               `json:"target_items"`      // ingredient item IDs to scan
+	TargetCategories []string            `json:"target_categories"` // material storage categories to scan, e.g. "Cooking Ingredients"
+	ProxyURL         string              `json:"proxy_url"`         // overrides the HTTP(S)_PROXY environment variables
+	UserAgent        string              `json:"user_agent"`
+	TraceRequests    bool                `json:"trace_requests"` // log every HTTP request at debug level
+	// FullRefreshInterval is how often every recipe and item is refetched (e.g. "168h");
+	// in between, refreshes only fetch IDs that are new
+	FullRefreshInterval string `json:"full_refresh_interval"`
+	// RefreshTTLs maps cache datasets (e.g. "tradeable") to how long they stay
+	// fresh within a build (e.g. "6h"), overriding the defaults. For recipes and
+	// items an expired TTL only fetches new IDs, see FullRefreshInterval.
+	RefreshTTLs map[string]string `json:"refresh_ttls"`
+	// CachePath is the local cache database, ":memory:" for an in-memory cache;
+	// defaults to gw2-mastercrafter/cache.db in the user cache directory
+	CachePath string `json:"cache_path"`
+	// PriceWatchlist are the item IDs whose prices are snapshotted, the target
+	// items when empty
+	PriceWatchlist []int `json:"price_watchlist"`
+}
+
+// AccountConfig is a named account profile. When any are configured, the
+// crafter runs once per account and ApiKey is ignored.
+type AccountConfig struct {
+	Name   string `json:"name"`
+	ApiKey string `json:"api_key"`
+}
+
+// ResponseCacheConfig enables the on-disk HTTP response cache when Dir is set.
+// MaxAge maps endpoint prefixes (e.g. "/commerce") to durations (e.g. "5m").
+type ResponseCacheConfig struct {
+	Dir    string            `json:"dir"`
+	MaxAge map[string]string `json:"max_age"`
 }
 
 func ReadConfig() Config {
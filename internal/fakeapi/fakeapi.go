@@ -0,0 +1,434 @@
+// Package fakeapi provides an in-process fake of the GW2 API endpoints used by
+// gw2-mastercrafter, for offline tests through net/http/httptest.
+//
+// Resources are seeded from Go values or JSON fixtures and served back with the
+// same paths, query parameters and status codes as https://api.guildwars2.com/v2:
+//
+//	fake := fakeapi.New()
+//	fake.AddItems(map[string]any{"id": 19718, "name": "Jute Scrap"})
+//	server := httptest.NewServer(fake)
+//	defer server.Close()
+package fakeapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Server is an http.Handler serving seeded GW2 API resources
+type Server struct {
+	mu             sync.RWMutex
+	items          map[int]json.RawMessage
+	recipes        map[int]json.RawMessage
+	prices         map[int]json.RawMessage
+	currencies     map[int]json.RawMessage
+	categories     map[int]json.RawMessage
+	guildUpgrades  map[int]json.RawMessage
+	recipeIndex    map[int]recipeSummary
+	accountRecipes []int
+	characters     []json.RawMessage
+	materials      []json.RawMessage
+	dailyCrafting  []string
+	dailyCrafted   []string
+	buildID        int
+	authToken      string // when set, account endpoints require this bearer token
+}
+
+// recipeSummary keeps the fields needed to answer /recipes/search
+type recipeSummary struct {
+	ID           int `json:"id"`
+	OutputItemID int `json:"output_item_id"`
+	Ingredients  []struct {
+		ItemID int `json:"item_id"`
+	} `json:"ingredients"`
+}
+
+func New() *Server {
+	return &Server{
+		items:          make(map[int]json.RawMessage),
+		recipes:        make(map[int]json.RawMessage),
+		prices:         make(map[int]json.RawMessage),
+		currencies:     make(map[int]json.RawMessage),
+		categories:     make(map[int]json.RawMessage),
+		guildUpgrades:  make(map[int]json.RawMessage),
+		recipeIndex:    make(map[int]recipeSummary),
+		accountRecipes: []int{},
+		characters:     []json.RawMessage{},
+		materials:      []json.RawMessage{},
+		dailyCrafting:  []string{},
+		dailyCrafted:   []string{},
+	}
+}
+
+// toRaw marshals a seed value and extracts its "id" field
+func toRaw(value any) (int, json.RawMessage, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return 0, nil, err
+	}
+	var identified struct {
+		ID *int `json:"id"`
+	}
+	if err := json.Unmarshal(data, &identified); err != nil {
+		return 0, nil, err
+	}
+	if identified.ID == nil {
+		return 0, nil, fmt.Errorf("Seed value %s has no id field", data)
+	}
+	return *identified.ID, data, nil
+}
+
+func (s *Server) add(target map[int]json.RawMessage, values []any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, value := range values {
+		id, data, err := toRaw(value)
+		if err != nil {
+			return err
+		}
+		target[id] = data
+	}
+	return nil
+}
+
+// AddItems seeds /items with values marshalling to the API's item JSON
+func (s *Server) AddItems(items ...any) error {
+	return s.add(s.items, items)
+}
+
+// AddPrices seeds /commerce/prices with values marshalling to the API's price JSON
+func (s *Server) AddPrices(prices ...any) error {
+	return s.add(s.prices, prices)
+}
+
+// AddCurrencies seeds /currencies with values marshalling to the API's currency JSON
+func (s *Server) AddCurrencies(currencies ...any) error {
+	return s.add(s.currencies, currencies)
+}
+
+// AddRecipes seeds /recipes and indexes the recipes for /recipes/search
+func (s *Server) AddRecipes(recipes ...any) error {
+	if err := s.add(s.recipes, recipes); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, data := range s.recipes {
+		var summary recipeSummary
+		if err := json.Unmarshal(data, &summary); err != nil {
+			return err
+		}
+		s.recipeIndex[summary.ID] = summary
+	}
+	return nil
+}
+
+// AddMaterialCategories seeds /materials with values marshalling to the API's category JSON
+func (s *Server) AddMaterialCategories(categories ...any) error {
+	return s.add(s.categories, categories)
+}
+
+// AddGuildUpgrades seeds /guild/upgrades with values marshalling to the API's upgrade JSON
+func (s *Server) AddGuildUpgrades(upgrades ...any) error {
+	return s.add(s.guildUpgrades, upgrades)
+}
+
+// SetAccountRecipes sets the recipe IDs returned by /account/recipes
+func (s *Server) SetAccountRecipes(recipeIDs ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accountRecipes = recipeIDs
+}
+
+func toRawList(values []any) ([]json.RawMessage, error) {
+	list := make([]json.RawMessage, len(values))
+	for i, value := range values {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = data
+	}
+	return list, nil
+}
+
+// SetCharacters sets the characters returned by /characters?ids=all
+func (s *Server) SetCharacters(characters ...any) error {
+	list, err := toRawList(characters)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.characters = list
+	return nil
+}
+
+// SetMaterials sets the material storage returned by /account/materials
+func (s *Server) SetMaterials(materials ...any) error {
+	list, err := toRawList(materials)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.materials = list
+	return nil
+}
+
+// SetDailyCrafting sets the time-gated craft IDs returned by /dailycrafting
+func (s *Server) SetDailyCrafting(dailyIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dailyCrafting = dailyIDs
+}
+
+// SetAccountDailyCrafting sets the crafts already made today, returned by /account/dailycrafting
+func (s *Server) SetAccountDailyCrafting(dailyIDs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dailyCrafted = dailyIDs
+}
+
+// SetBuild sets the build number returned by /build and the CDN manifest path
+func (s *Server) SetBuild(buildID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buildID = buildID
+}
+
+// RequireToken makes account endpoints reject requests without this bearer token
+func (s *Server) RequireToken(authToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authToken = authToken
+}
+
+// LoadFixtures seeds the server from a directory containing any of items.json,
+// recipes.json, prices.json, currencies.json, categories.json and
+// guild_upgrades.json (JSON arrays in API format),
+// account_recipes.json (array of IDs), characters.json and materials.json
+// (JSON arrays in API format) and build.json ({"id": N})
+func (s *Server) LoadFixtures(dir string) error {
+	seeders := map[string]func(...any) error{
+		"items.json":          s.AddItems,
+		"recipes.json":        s.AddRecipes,
+		"prices.json":         s.AddPrices,
+		"currencies.json":     s.AddCurrencies,
+		"categories.json":     s.AddMaterialCategories,
+		"guild_upgrades.json": s.AddGuildUpgrades,
+		"characters.json":     s.SetCharacters,
+		"materials.json":      s.SetMaterials,
+	}
+	for name, seed := range seeders {
+		var values []json.RawMessage
+		found, err := readFixture(filepath.Join(dir, name), &values)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		seedValues := make([]any, len(values))
+		for i, value := range values {
+			seedValues[i] = value
+		}
+		if err := seed(seedValues...); err != nil {
+			return fmt.Errorf("Failed to seed %s: %w", name, err)
+		}
+	}
+
+	var accountRecipes []int
+	found, err := readFixture(filepath.Join(dir, "account_recipes.json"), &accountRecipes)
+	if err != nil {
+		return err
+	}
+	if found {
+		s.SetAccountRecipes(accountRecipes...)
+	}
+
+	var build struct {
+		ID int `json:"id"`
+	}
+	found, err = readFixture(filepath.Join(dir, "build.json"), &build)
+	if err != nil {
+		return err
+	}
+	if found {
+		s.SetBuild(build.ID)
+	}
+	return nil
+}
+
+func readFixture(path string, target any) (bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(data, target); err != nil {
+		return false, fmt.Errorf("Failed to parse fixture %s: %w", path, err)
+	}
+	return true, nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, value any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, text string) {
+	writeJSON(w, statusCode, map[string]string{"text": text})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2"), "/")
+	switch {
+	case path == "/build":
+		writeJSON(w, http.StatusOK, map[string]int{"id": s.buildID})
+	case path == "/latest/101":
+		// Mirrors the asset CDN manifest format: "<build> <size> <build> <size> ..."
+		fmt.Fprintf(w, "%d 0 %d 0", s.buildID, s.buildID)
+	case path == "/dailycrafting":
+		writeJSON(w, http.StatusOK, s.dailyCrafting)
+	case path == "/recipes/search":
+		s.serveRecipeSearch(w, r)
+	case path == "/account/recipes" || path == "/account/materials" || path == "/account/dailycrafting" || path == "/characters":
+		if s.authToken != "" && r.Header.Get("Authorization") != "Bearer "+s.authToken {
+			writeError(w, http.StatusUnauthorized, "Invalid access token")
+			return
+		}
+		accountData := map[string]any{
+			"/account/recipes":       s.accountRecipes,
+			"/account/materials":     s.materials,
+			"/account/dailycrafting": s.dailyCrafted,
+			"/characters":            s.characters,
+		}
+		writeJSON(w, http.StatusOK, accountData[path])
+	default:
+		resources := map[string]map[int]json.RawMessage{
+			"/items":           s.items,
+			"/recipes":         s.recipes,
+			"/commerce/prices": s.prices,
+			"/currencies":      s.currencies,
+			"/materials":       s.categories,
+			"/guild/upgrades":  s.guildUpgrades,
+		}
+		for prefix, resource := range resources {
+			if path == prefix {
+				serveCollection(w, r, resource)
+				return
+			}
+			if idStr, found := strings.CutPrefix(path, prefix+"/"); found {
+				serveSingle(w, idStr, resource)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func sortedIDs(resource map[int]json.RawMessage) []int {
+	ids := make([]int, 0, len(resource))
+	for id := range resource {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func serveSingle(w http.ResponseWriter, idStr string, resource map[int]json.RawMessage) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	data, ok := resource[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such id")
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// serveCollection answers ID listings and bulk ?ids= requests. As in the real API,
+// partially resolved bulk requests return 206 and fully unresolved ones 404.
+func serveCollection(w http.ResponseWriter, r *http.Request, resource map[int]json.RawMessage) {
+	idsParam := r.URL.Query().Get("ids")
+	if idsParam == "" {
+		writeJSON(w, http.StatusOK, sortedIDs(resource))
+		return
+	}
+
+	var ids []int
+	if idsParam == "all" {
+		ids = sortedIDs(resource)
+	} else {
+		for _, idStr := range strings.Split(idsParam, ",") {
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid ids")
+				return
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	found := []json.RawMessage{}
+	for _, id := range ids {
+		if data, ok := resource[id]; ok {
+			found = append(found, data)
+		}
+	}
+	switch {
+	case len(found) == 0 && len(ids) > 0:
+		writeError(w, http.StatusNotFound, "all ids provided are invalid")
+	case len(found) < len(ids):
+		writeJSON(w, http.StatusPartialContent, found)
+	default:
+		writeJSON(w, http.StatusOK, found)
+	}
+}
+
+func (s *Server) serveRecipeSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	input, output := query.Get("input"), query.Get("output")
+	if (input == "") == (output == "") {
+		writeError(w, http.StatusBadRequest, "exactly one of input or output is required")
+		return
+	}
+	itemID, err := strconv.Atoi(input + output)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid item id")
+		return
+	}
+
+	matches := []int{}
+	for _, id := range sortedIDs(s.recipes) {
+		summary := s.recipeIndex[id]
+		if output != "" && summary.OutputItemID == itemID {
+			matches = append(matches, id)
+			continue
+		}
+		for _, ingredient := range summary.Ingredients {
+			if input != "" && ingredient.ItemID == itemID {
+				matches = append(matches, id)
+				break
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, matches)
+}
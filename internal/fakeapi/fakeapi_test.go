@@ -0,0 +1,70 @@
+package fakeapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	fake := New()
+	err := fake.AddRecipes(
+		map[string]any{"id": 1, "output_item_id": 100, "ingredients": []map[string]int{{"item_id": 10, "count": 2}}},
+		map[string]any{"id": 2, "output_item_id": 200, "ingredients": []map[string]int{{"item_id": 10, "count": 1}, {"item_id": 11, "count": 1}}},
+	)
+	if err != nil {
+		t.Fatalf("AddRecipes() returned error: %v", err)
+	}
+	fake.RequireToken("token")
+	fake.SetAccountRecipes(2)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+		want       any
+	}{
+		{"Listing returns all ids", "/v2/recipes", "", http.StatusOK, []any{1.0, 2.0}},
+		{"Search by input", "/v2/recipes/search?input=10", "", http.StatusOK, []any{1.0, 2.0}},
+		{"Search by output", "/v2/recipes/search?output=200", "", http.StatusOK, []any{2.0}},
+		{"Missing single id returns 404", "/v2/recipes/3", "", http.StatusNotFound, map[string]any{"text": "no such id"}},
+		{"Partial bulk request returns 206", "/v2/recipes?ids=2,3", "", http.StatusPartialContent, nil},
+		{"Account endpoint requires token", "/v2/account/recipes", "", http.StatusUnauthorized, nil},
+		{"Account endpoint with token", "/v2/account/recipes", "token", http.StatusOK, []any{2.0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("GET %s returned status %d, want %d", tt.path, resp.StatusCode, tt.wantStatus)
+			}
+			if tt.want == nil {
+				return
+			}
+			var got any
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GET %s returned %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
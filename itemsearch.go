@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// defaultSearchLimit caps SearchItems results when no limit is given
+const defaultSearchLimit = 20
+
+// An ItemSearch is a name search over the cached items. Zero values are ignored.
+type ItemSearch struct {
+	Query  string // words matched against the start of words in the item name
+	Type   string
+	Rarity string
+	Fuzzy  bool // also match words within a few typos of the query
+	Limit  int
+}
+
+// fts5Available reports whether the SQLite driver was built with FTS5, which
+// needs the sqlite_fts5 build tag
+func fts5Available(db sqlx.Queryer) (bool, error) {
+	var available bool
+	err := sqlx.Get(db, &available, "SELECT sqlite_compileoption_used('ENABLE_FTS5')")
+	return available, err
+}
+
+// itemSearchIndexed reports whether the items_fts index exists and can be used
+func itemSearchIndexed(db sqlx.Queryer) (bool, error) {
+	available, err := fts5Available(db)
+	if err != nil || !available {
+		return false, err
+	}
+	var exists bool
+	err = sqlx.Get(db, &exists, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'items_fts')")
+	return exists, err
+}
+
+// ensureItemSearchIndex creates the item name index when FTS5 is available,
+// and rebuilds it when items were refreshed since it was last built. It is not
+// a migration because builds without FTS5 have to keep working on the same
+// cache; they fall back to slower LIKE searches and leave the index stale.
+func ensureItemSearchIndex(db *sqlx.DB) error {
+	available, err := fts5Available(db)
+	if err != nil {
+		return err
+	}
+	if !available {
+		logger.Debug("Item search index unavailable, build with -tags sqlite_fts5 for faster searches")
+		return nil
+	}
+	indexed, err := itemSearchIndexed(db)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		var stale bool
+		err = db.Get(&stale, "SELECT EXISTS (SELECT 1 FROM dataset_metadata WHERE dataset = 'items' AND last_refreshed IS NOT search_indexed)")
+		if err != nil {
+			return fmt.Errorf("Failed to check item search index: %w", err)
+		}
+		if !stale {
+			return nil
+		}
+		logger.Info("Items were refreshed since the search index was built, rebuilding it")
+	} else {
+		_, err = db.Exec(`
+    CREATE VIRTUAL TABLE items_fts USING fts5 (
+      name,
+      content = 'items',
+      content_rowid = 'id',
+      tokenize = 'unicode61 remove_diacritics 2',
+      prefix = '2 3'
+    );
+  `)
+		if err != nil {
+			return fmt.Errorf("Failed to create item search index: %w", err)
+		}
+	}
+	return rebuildItemSearchIndex(db)
+}
+
+// rebuildItemSearchIndex reindexes every item name and records the items
+// refresh it was built from. Items are replaced in bulk by refreshes, so the
+// index is rebuilt afterwards rather than kept in sync by triggers, which
+// would break builds without FTS5.
+func rebuildItemSearchIndex(db sqlx.Ext) error {
+	indexed, err := itemSearchIndexed(db)
+	if err != nil || !indexed {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO items_fts (items_fts) VALUES ('rebuild')")
+	if err != nil {
+		return fmt.Errorf("Failed to rebuild item search index: %w", err)
+	}
+	_, err = db.Exec("UPDATE dataset_metadata SET search_indexed = last_refreshed WHERE dataset = 'items'")
+	if err != nil {
+		return fmt.Errorf("Failed to record item search index rebuild: %w", err)
+	}
+	return nil
+}
+
+// SearchItems finds items by name. Every query word has to match the start of
+// a word in the name; with Fuzzy set, names whose words are within a few typos
+// of the query are added after the prefix matches, closest first.
+func (lc *LocalCache) SearchItems(search ItemSearch) ([]Item, error) {
+	words := searchWords(search.Query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	limit := search.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	items, err := lc.searchItemPrefixes(words, search, limit)
+	if err != nil {
+		return nil, err
+	}
+	if !search.Fuzzy || len(items) >= limit {
+		return items, nil
+	}
+	fuzzyItems, err := lc.searchItemsFuzzy(words, search, items, limit-len(items))
+	if err != nil {
+		return nil, err
+	}
+	return append(items, fuzzyItems...), nil
+}
+
+// searchItemPrefixes uses the FTS5 index when there is one and a LIKE scan
+// otherwise. Shorter names rank first in both, which puts base materials
+// before the items named after them.
+func (lc *LocalCache) searchItemPrefixes(words []string, search ItemSearch, limit int) ([]Item, error) {
+	indexed, err := itemSearchIndexed(lc.db)
+	if err != nil {
+		return nil, err
+	}
+	var query string
+	var conditions []string
+	var args []interface{}
+	if indexed {
+		terms := make([]string, len(words))
+		for i, word := range words {
+			terms[i] = `"` + word + `"*`
+		}
+		query = "SELECT items.* FROM items_fts JOIN items ON items.id = items_fts.rowid"
+		conditions = append(conditions, "items_fts MATCH ?")
+		args = append(args, strings.Join(terms, " "))
+	} else {
+		query = "SELECT items.* FROM items"
+		for _, word := range words {
+			conditions = append(conditions, "(' ' || lower(name)) LIKE ? ESCAPE '\\'")
+			args = append(args, "% "+escapeLike(word)+"%")
+		}
+	}
+	filterConditions, filterArgs := itemSearchFilters(search)
+	conditions = append(conditions, filterConditions...)
+	args = append(args, filterArgs...)
+	query += " WHERE " + strings.Join(conditions, " AND ") + " ORDER BY length(items.name), items.id LIMIT ?"
+	args = append(args, limit)
+
+	var items []Item
+	err = lc.db.Select(&items, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to search items: %w", err)
+	}
+	return items, nil
+}
+
+// searchItemsFuzzy scores every name passing the filters by its total edit
+// distance to the query words, skipping the items already found
+func (lc *LocalCache) searchItemsFuzzy(words []string, search ItemSearch, found []Item, limit int) ([]Item, error) {
+	query := "SELECT id, name FROM items"
+	conditions, args := itemSearchFilters(search)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	var candidates []struct {
+		ID   int    `db:"id"`
+		Name string `db:"name"`
+	}
+	if err := lc.db.Select(&candidates, query, args...); err != nil {
+		return nil, fmt.Errorf("Failed to search items: %w", err)
+	}
+
+	skip := make(map[int]bool, len(found))
+	for _, item := range found {
+		skip[item.ID] = true
+	}
+	type match struct {
+		id, distance, length int
+	}
+	var matches []match
+	for _, candidate := range candidates {
+		if skip[candidate.ID] {
+			continue
+		}
+		if distance, ok := fuzzyNameDistance(words, searchWords(candidate.Name)); ok {
+			matches = append(matches, match{candidate.ID, distance, len(candidate.Name)})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		if matches[i].length != matches[j].length {
+			return matches[i].length < matches[j].length
+		}
+		return matches[i].id < matches[j].id
+	})
+
+	var items []Item
+	for _, m := range matches[:min(limit, len(matches))] {
+		item, err := lc.GetItemById(m.id)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+	return items, nil
+}
+
+func itemSearchFilters(search ItemSearch) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if search.Type != "" {
+		conditions = append(conditions, "items.type = ?")
+		args = append(args, search.Type)
+	}
+	if search.Rarity != "" {
+		conditions = append(conditions, "items.rarity = ?")
+		args = append(args, search.Rarity)
+	}
+	return conditions, args
+}
+
+// fuzzyNameDistance matches every query word against its closest name word,
+// allowing a prefix of the name word to stand in for it. It fails when any
+// word is further away than maxTypos allows.
+func fuzzyNameDistance(queryWords, nameWords []string) (int, bool) {
+	total := 0
+	for _, queryWord := range queryWords {
+		best := -1
+		for _, nameWord := range nameWords {
+			distance := levenshtein(queryWord, nameWord)
+			if runes := []rune(nameWord); len(runes) > len([]rune(queryWord)) {
+				distance = min(distance, levenshtein(queryWord, string(runes[:len([]rune(queryWord))])))
+			}
+			if best < 0 || distance < best {
+				best = distance
+			}
+		}
+		if best < 0 || best > maxTypos(queryWord) {
+			return 0, false
+		}
+		total += best
+	}
+	return total, true
+}
+
+// maxTypos is how many edits a query word tolerates; short words have to match exactly
+func maxTypos(word string) int {
+	switch length := len([]rune(word)); {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// searchWords lowercases text and splits it into words of letters and digits
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSearchItems(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	items := []Item{
+		{ID: 1, Name: "Mithril Ore", Type: "CraftingMaterial", Rarity: "Basic"},
+		{ID: 2, Name: "Mithril Ingot", Type: "CraftingMaterial", Rarity: "Basic"},
+		{ID: 3, Name: "Lump of Mithrillium", Type: "CraftingMaterial", Rarity: "Exotic"},
+		{ID: 4, Name: "Mithril Axe Blade", Type: "UpgradeComponent", Rarity: "Fine"},
+		{ID: 5, Name: "Orichalcum Ore", Type: "CraftingMaterial", Rarity: "Basic"},
+		{ID: 6, Name: "Glob of Ectoplasm", Type: "CraftingMaterial", Rarity: "Exotic"},
+		{ID: 7, Name: "100% Pure Ore", Type: "Trophy", Rarity: "Junk"},
+	}
+	if err := updateItemCache(db, items); err != nil {
+		t.Fatalf("Failed to update item cache: %v", err)
+	}
+	if err := rebuildItemSearchIndex(db); err != nil {
+		t.Fatalf("Failed to rebuild item search index: %v", err)
+	}
+	lc := NewLocalCache(db)
+
+	tests := []struct {
+		name   string
+		search ItemSearch
+		want   []int
+	}{
+		{"Single word prefix", ItemSearch{Query: "mithr"}, []int{1, 2, 4, 3}},
+		{"Every word has to match", ItemSearch{Query: "mithril ore"}, []int{1}},
+		{"Matches the start of any word", ItemSearch{Query: "ore"}, []int{1, 7, 5}},
+		{"Case and punctuation are ignored", ItemSearch{Query: "GLOB, ecto"}, []int{6}},
+		{"Type filter", ItemSearch{Query: "mithril", Type: "UpgradeComponent"}, []int{4}},
+		{"Rarity filter", ItemSearch{Query: "mithr", Rarity: "Exotic"}, []int{3}},
+		{"Limit", ItemSearch{Query: "ore", Limit: 1}, []int{1}},
+		{"Typos need fuzzy matching", ItemSearch{Query: "ectoplasn"}, nil},
+		{"Fuzzy match", ItemSearch{Query: "ectoplasn", Fuzzy: true}, []int{6}},
+		{"Fuzzy matches follow prefix matches", ItemSearch{Query: "orichalcum", Fuzzy: true}, []int{5}},
+		{"Fuzzy prefix of a longer word", ItemSearch{Query: "orichalc ore", Fuzzy: true}, []int{5}},
+		{"Short words must match exactly", ItemSearch{Query: "ote", Fuzzy: true}, nil},
+		{"Empty query", ItemSearch{Query: " - "}, nil},
+	}
+	for _, tt := range tests {
+		found, err := lc.SearchItems(tt.search)
+		if err != nil {
+			t.Fatalf("%s: SearchItems() returned error: %v", tt.name, err)
+		}
+		var got []int
+		for _, item := range found {
+			got = append(got, item.ID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: SearchItems(%+v) = %v, want %v", tt.name, tt.search, got, tt.want)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"ore", "", 3},
+		{"mithril", "mithril", 0},
+		{"mithril", "mithirl", 2},
+		{"ectoplasm", "ectoplasn", 1},
+		{"kitten", "sitting", 3},
+		{"über", "uber", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestEnsureItemSearchIndexRebuildsStaleIndex(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	if available, err := fts5Available(db); err != nil || !available {
+		t.Skip("SQLite driver built without FTS5, use -tags sqlite_fts5")
+	}
+	if err := storeDatasetTTLs(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	refreshedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := updateItemCache(db, []Item{{ID: 1, Name: "Mithril Ore"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE dataset_metadata SET last_refreshed = ? WHERE dataset = 'items'", refreshedAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := rebuildItemSearchIndex(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// A build without FTS5 refreshes items and leaves the index as it was
+	if err := updateItemCache(db, []Item{{ID: 2, Name: "Mithril Ingot"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE dataset_metadata SET last_refreshed = ? WHERE dataset = 'items'", refreshedAt.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ensureItemSearchIndex(db); err != nil {
+		t.Fatalf("ensureItemSearchIndex() returned error: %v", err)
+	}
+	found, err := NewLocalCache(db).SearchItems(ItemSearch{Query: "ingot"})
+	if err != nil || len(found) != 1 || found[0].ID != 2 {
+		t.Errorf("SearchItems() after reopening = %v, %v, want item 2", found, err)
+	}
+}
@@ -9,7 +9,8 @@ import (
 var logger = NewSLogLogger()
 
 type SLogLogger struct {
-	log *slog.Logger // slog Logger instance
+	log     *slog.Logger // slog Logger instance
+	onFatal []func()     // run before Fatal exits, since deferred calls are skipped
 }
 
 var logLevel = new(slog.LevelVar) // Log Level control variable
@@ -37,9 +38,19 @@ func (sl *SLogLogger) Error(msg string, metadata ...interface{}) {
 
 func (sl *SLogLogger) Fatal(msg string, metadata ...interface{}) {
 	sl.log.Error(msg, metadata...)
+	hooks := sl.onFatal
+	sl.onFatal = nil // a hook calling Fatal must not run the hooks again
+	for _, hook := range hooks {
+		hook()
+	}
 	log.Fatal(msg)
 }
 
+// OnFatal registers fn to run when Fatal is called, before the process exits
+func (sl *SLogLogger) OnFatal(fn func()) {
+	sl.onFatal = append(sl.onFatal, fn)
+}
+
 func (sl *SLogLogger) SetLevel(level string) {
 	switch level {
 	case "DEBUG":
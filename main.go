@@ -1,16 +1,52 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	config "github.com/deadpyxel/gw2-mastercrafter/internal"
-	"github.com/jmoiron/sqlx"
 )
 
 var configObj config.Config
 
+// defaultTargetItems are the common crafting materials scanned when no targets are configured
+var defaultTargetItems = []int{19718, 19739, 19741, 19743, 19748, 19745, 19719, 19728, 19730, 19731, 19729, 19732, 19697, 19704, 19703, 19699, 19698, 19702, 19700, 19701, 19723, 19726, 19727, 19724, 19722, 19725}
+
+// stringListFlag collects the values of a flag that can be repeated
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
+	profitReportWindow := flag.Duration("profit-report", 0, "Sync Trading Post history and report realized profit over this window (e.g. 168h), then exit")
+	recordDir := flag.String("record", "", "Save every API request/response to this fixture directory")
+	replayDir := flag.String("replay", "", "Serve API responses from this fixture directory instead of the network")
+	cachePath := flag.String("cache", "", fmt.Sprintf("Path of the local cache database, %q to keep it in memory (overrides %s and the config)", InMemoryCache, cachePathEnv))
+	fullRefresh := flag.Bool("full-refresh", false, "Refetch every recipe and item instead of only new ones when the cache is refreshed")
+	snapshotPrices := flag.Bool("snapshot-prices", false, "Record the current Trading Post prices of the watchlist in the price history, then exit")
+	priceHistoryWindow := flag.Duration("price-history", 0, "Report the recorded price history of the watchlist over this window (e.g. 168h), then exit")
+	searchQuery := flag.String("search", "", "Search cached items by name, tolerating typos, and print their IDs, then exit (indexed when built with -tags sqlite_fts5)")
+	searchType := flag.String("search-type", "", "Only search items of this type, e.g. \"CraftingMaterial\"")
+	searchRarity := flag.String("search-rarity", "", "Only search items of this rarity, e.g. \"Exotic\"")
+	lintMerchants := flag.Bool("lint-merchants", false, "Check the merchant data file against the cached items and currencies, then exit")
+	scribeCosts := flag.Bool("scribe-costs", false, "Report the cost of every Scribe guild decoration recipe, then exit")
+	var targetCategories, refreshDatasets stringListFlag
+	flag.Var(&targetCategories, "category", "Material storage category to scan, e.g. \"Cooking Ingredients\" (repeatable, overrides config)")
+	flag.Var(&refreshDatasets, "refresh", fmt.Sprintf("Refresh a cache dataset even if it has not expired, refetching every entry, one of %s (repeatable)", strings.Join(CacheDatasetNames(), ", ")))
+	flag.Parse()
+
 	// Load API Token, create API client instance
 	apiToken := os.Getenv("API_TOKEN")
 	configObj = config.ReadConfig()
@@ -18,21 +54,210 @@ func main() {
 	if apiToken == "" {
 		apiToken = configObj.ApiKey
 	}
-	gw2Client := NewAPIClient("https://api.guildwars2.com/v2", apiToken)
+	if apiToken == "" && len(configObj.Accounts) > 0 {
+		// Shared calls such as prices and the transaction report use the first account
+		apiToken = configObj.Accounts[0].ApiKey
+	}
+	// Every client reports into the same metrics, logged when the run ends,
+	// including runs ending in logger.Fatal
+	requestMetrics := NewRequestMetrics()
+	defer requestMetrics.LogStats()
+	logger.OnFatal(requestMetrics.LogStats)
+	clientOptions := []ClientOption{WithRequestMetrics(requestMetrics)}
+	switch {
+	case *recordDir != "" && *replayDir != "":
+		logger.Fatal("Cannot record and replay API traffic at the same time")
+	case *recordDir != "":
+		transport, err := NewRecordingTransport(*recordDir, nil)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error setting up API recording: %v", err))
+		}
+		clientOptions = append(clientOptions, WithTransport(transport))
+	case *replayDir != "":
+		transport, err := NewReplayTransport(*replayDir)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error setting up API replay: %v", err))
+		}
+		clientOptions = append(clientOptions, WithTransport(transport))
+	}
+	if configObj.ProxyURL != "" {
+		proxyURL, err := url.Parse(configObj.ProxyURL)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Invalid proxy URL: %v", err))
+		}
+		clientOptions = append(clientOptions, WithProxy(proxyURL))
+	}
+	if configObj.UserAgent != "" {
+		clientOptions = append(clientOptions, WithMiddleware(UserAgentMiddleware(configObj.UserAgent)))
+	}
+	if configObj.TraceRequests {
+		clientOptions = append(clientOptions, WithMiddleware(TracingMiddleware()))
+	}
+	if len(configObj.BuildSources) > 0 {
+		buildSources, err := NewBuildSources(configObj.BuildSources, configObj.BuildCDNURL, configObj.PinnedBuild)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error setting up build number sources: %v", err))
+		}
+		clientOptions = append(clientOptions, WithBuildSources(buildSources...))
+	}
+	// Replayed runs skip the response cache so they match the recording exactly
+	if configObj.ResponseCache.Dir != "" && *replayDir == "" {
+		responseCache, err := newResponseCacheFromConfig(configObj.ResponseCache)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error setting up response cache: %v", err))
+		}
+		clientOptions = append(clientOptions, WithResponseCache(responseCache))
+	}
+	gw2Client := NewAPIClient("https://api.guildwars2.com/v2", apiToken, clientOptions...)
 
-	UpdateCache(gw2Client)
+	refreshOptions := CacheRefreshOptions{ForceFull: *fullRefresh, ForceDatasets: refreshDatasets, DatasetTTLs: make(map[string]time.Duration)}
+	if configObj.FullRefreshInterval != "" {
+		interval, err := time.ParseDuration(configObj.FullRefreshInterval)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Invalid full refresh interval: %v", err))
+		}
+		refreshOptions.FullRefreshInterval = interval
+	}
+	for dataset, value := range configObj.RefreshTTLs {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Invalid refresh TTL %q for %s: %v", value, dataset, err))
+		}
+		refreshOptions.DatasetTTLs[dataset] = ttl
+	}
 
-	// Initialize Local SQLite Cache connection
-	db, err := sqlx.Connect("sqlite3", "cache.db")
+	// Every component shares this connection to the local cache
+	dbPath, err := ResolveCachePath(*cachePath, configObj.CachePath)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Error locating local cache: %v", err))
+	}
+	logger.Debug("Using local cache", "path", dbPath)
+	db, err := OpenCache(dbPath)
 	if err != nil {
-		logger.Fatal(fmt.Sprintf("Error updating local cache: %v", err))
+		logger.Fatal(fmt.Sprintf("Error opening local cache: %v", err))
 	}
 	defer db.Close()
+	UpdateCache(gw2Client, db, refreshOptions)
 	localCache := NewLocalCache(db)
+	// Crafters copy the cache, so the graph has to be loaded before creating them
+	if err := localCache.LoadRecipeGraph(); err != nil {
+		logger.Fatal(fmt.Sprintf("Error loading recipe cache: %v", err))
+	}
 
 	// Create crafter instance
 	crafter := NewCrafter(*gw2Client, *localCache)
-	targetItems := []int{19718, 19739, 19741, 19743, 19748, 19745, 19719, 19728, 19730, 19731, 19729, 19732, 19697, 19704, 19703, 19699, 19698, 19702, 19700, 19701, 19723, 19726, 19727, 19724, 19722, 19725}
+
+	if *profitReportWindow > 0 {
+		err = SyncTransactionHistory(gw2Client, db)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error syncing transaction history: %v", err))
+		}
+		until := time.Now()
+		realizedProfits, err := crafter.RealizedProfits(until.Add(-*profitReportWindow), until)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error building realized profit report: %v", err))
+		}
+		for _, realizedProfit := range realizedProfits {
+			logger.Info("Realized profit", "recipeID", realizedProfit.RecipeID, "itemID", realizedProfit.OutputItemID, "unitsSold", realizedProfit.UnitsSold, "revenue", realizedProfit.Revenue, "ingredientCost", realizedProfit.IngredientCost, "profit", realizedProfit.Profit, "profitMargin", realizedProfit.ProfitMargin)
+		}
+		return
+	}
+
+	if *lintMerchants {
+		issues, err := localCache.LintMerchantDataFile(merchantDataFile)
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error checking merchant data: %v", err))
+		}
+		errorCount := 0
+		for _, issue := range issues {
+			if issue.Warning {
+				logger.Warn(fmt.Sprintf("%s:%s", merchantDataFile, issue))
+				continue
+			}
+			errorCount++
+			logger.Error(fmt.Sprintf("%s:%s", merchantDataFile, issue))
+		}
+		if errorCount > 0 {
+			logger.Fatal("Merchant data has errors", "errors", errorCount, "warnings", len(issues)-errorCount)
+		}
+		logger.Info("Merchant data is valid", "warnings", len(issues))
+		return
+	}
+
+	if *searchQuery != "" {
+		items, err := localCache.SearchItems(ItemSearch{Query: *searchQuery, Type: *searchType, Rarity: *searchRarity, Fuzzy: true})
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error searching items: %v", err))
+		}
+		for _, item := range items {
+			logger.Info("Item", "itemID", item.ID, "name", item.Name, "type", item.Type, "rarity", item.Rarity, "level", item.Level)
+		}
+		if len(items) == 0 {
+			logger.Info("No items found", "query", *searchQuery)
+		}
+		return
+	}
+
+	if *scribeCosts {
+		decorationCosts, err := crafter.ScribeDecorationCosts()
+		if err != nil {
+			logger.Fatal(fmt.Sprintf("Error costing guild decorations: %v", err))
+		}
+		for _, decorationCost := range decorationCosts {
+			logger.Info("Guild decoration cost", "recipeID", decorationCost.RecipeID, "upgradeID", decorationCost.OutputUpgradeID, "cost", decorationCost.Cost, "untradableIngredients", decorationCost.UntradableIngredients, "uncraftableUpgrades", decorationCost.UncraftableUpgrades)
+		}
+		return
+	}
+
+	if len(targetCategories) == 0 {
+		targetCategories = configObj.TargetCategories
+	}
+	targetItems, err := resolveTargetItems(localCache, targetCategories, configObj.TargetItems)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Error resolving target items: %v", err))
+	}
+	if *snapshotPrices || *priceHistoryWindow > 0 {
+		// Without a configured watchlist, the scanned target items are tracked
+		watchlist := configObj.PriceWatchlist
+		if len(watchlist) == 0 {
+			watchlist = targetItems
+		}
+		if *snapshotPrices {
+			recorded, err := SnapshotPrices(gw2Client, db, watchlist, time.Now())
+			if err != nil {
+				logger.Fatal(fmt.Sprintf("Error recording price snapshot: %v", err))
+			}
+			logger.Info("Recorded price snapshot", "items", recorded)
+			return
+		}
+		until := time.Now()
+		for _, itemID := range watchlist {
+			stats, err := localCache.GetPriceStats(itemID, until.Add(-*priceHistoryWindow), until)
+			if err != nil {
+				logger.Fatal(fmt.Sprintf("Error loading price history: %v", err), "itemID", itemID)
+			}
+			logger.Info("Price history", "itemID", itemID, "snapshots", stats.Snapshots, "minBuy", stats.MinBuy, "maxBuy", stats.MaxBuy, "averageBuy", stats.AverageBuy, "minSell", stats.MinSell, "maxSell", stats.MaxSell, "averageSell", stats.AverageSell)
+		}
+		return
+	}
+	if len(configObj.Accounts) > 0 {
+		// Each account gets its own client and crafter, sharing the local cache
+		accounts := make([]Account, len(configObj.Accounts))
+		for i, accountConfig := range configObj.Accounts {
+			accountClient := NewAPIClient("https://api.guildwars2.com/v2", accountConfig.ApiKey, clientOptions...)
+			accounts[i] = Account{Name: accountConfig.Name, Crafter: NewCrafter(*accountClient, *localCache)}
+		}
+		for _, targetItem := range targetItems {
+			accountProfits, err := FindProfitableOptionsByAccount(accounts, targetItem, 1)
+			if err != nil {
+				logger.Fatal(fmt.Sprintf("Error finding profitable options: %s", err.Error()), "itemID", targetItem)
+			}
+			for _, accountProfit := range accountProfits {
+				logger.Info("Profitable recipe", "itemID", targetItem, "recipeID", accountProfit.RecipeID, "outputItemID", accountProfit.OutputItemID, "profitMargin", accountProfit.ProfitMargin, "accounts", accountProfit.Accounts, "recommendedAccount", accountProfit.RecommendedAccount, "craftsFromStorage", accountProfit.CraftsFromStorage)
+			}
+		}
+		return
+	}
 	for _, targetItem := range targetItems {
 		profitableRecipes, err := crafter.FindProfitableOptions(targetItem, 1)
 		if err != nil {
@@ -41,3 +266,43 @@ func main() {
 		logger.Info(fmt.Sprintf("Found %d profitable recipes for itemID %d: %v", len(profitableRecipes), targetItem, profitableRecipes), "itemID", targetItem)
 	}
 }
+
+// resolveTargetItems returns the items of the given material categories, falling
+// back to the configured item IDs and then to defaultTargetItems
+func resolveTargetItems(localCache *LocalCache, categories []string, itemIDs []int) ([]int, error) {
+	if len(categories) == 0 {
+		if len(itemIDs) > 0 {
+			return itemIDs, nil
+		}
+		return defaultTargetItems, nil
+	}
+	var targetItems []int
+	for _, category := range categories {
+		categoryItems, err := localCache.GetMaterialCategoryItems(category)
+		if err != nil {
+			return nil, err
+		}
+		for _, itemID := range categoryItems {
+			if !slices.Contains(targetItems, itemID) {
+				targetItems = append(targetItems, itemID)
+			}
+		}
+	}
+	return targetItems, nil
+}
+
+// newResponseCacheFromConfig applies configured max ages on top of the defaults
+func newResponseCacheFromConfig(cacheConfig config.ResponseCacheConfig) (*ResponseCache, error) {
+	maxAge := make(map[string]time.Duration, len(DefaultResponseCacheMaxAge))
+	for prefix, age := range DefaultResponseCacheMaxAge {
+		maxAge[prefix] = age
+	}
+	for prefix, value := range cacheConfig.MaxAge {
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid max age %q for %s: %w", value, prefix, err)
+		}
+		maxAge[prefix] = age
+	}
+	return NewResponseCache(cacheConfig.Dir, maxAge)
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
 )
 
 type MerchantPrice struct {
@@ -20,10 +26,11 @@ type MerchantOptions struct {
 }
 
 type Merchant struct {
-	Name            string            `json:"name" db:"name"`                           // Merchant name
-	Locations       StringSlice       `json:"locations" db:"location"`                  // Merchant locations
-	DisplayName     string            `json:"display_name,omitempty" db:"display_name"` // Display name for merchant
-	PurchaseOptions []MerchantOptions `json:"purchase_options"`                         // Offerings by merchant
+	Name             string            `json:"name" db:"name"`                           // Merchant name
+	Locations        StringSlice       `json:"locations" db:"location"`                  // Merchant locations
+	DisplayName      string            `json:"display_name,omitempty" db:"display_name"` // Display name for merchant
+	DisplayLocations StringSlice       `json:"display_locations,omitempty"`              // Locations shown to users, e.g. "Mystic Forge"
+	PurchaseOptions  []MerchantOptions `json:"purchase_options"`                         // Offerings by merchant
 }
 
 func ParseMerchantDataFile(filepath string) ([]Merchant, error) {
@@ -38,3 +45,199 @@ func ParseMerchantDataFile(filepath string) ([]Merchant, error) {
 	}
 	return merchants, nil
 }
+
+// MerchantImportReport counts the changes made by importMerchantData
+type MerchantImportReport struct {
+	MerchantsAdded   int
+	MerchantsUpdated int
+	MerchantsRemoved int
+	OfferingsAdded   int
+	OfferingsUpdated int
+	OfferingsRemoved int
+	Duplicates       int // offerings listed more than once by the same merchant
+}
+
+// Changed reports whether the import modified the cache
+func (r MerchantImportReport) Changed() bool {
+	return r.MerchantsAdded+r.MerchantsUpdated+r.MerchantsRemoved+r.OfferingsAdded+r.OfferingsUpdated+r.OfferingsRemoved > 0
+}
+
+// priceKey identifies the price list of an offering independently of its order.
+// Merchants can sell the same item for different currencies, so it is part of
+// the natural key of an offering.
+func priceKey(prices []MerchantPrice) string {
+	parts := make([]string, len(prices))
+	for i, price := range prices {
+		parts[i] = fmt.Sprintf("%s:%d:%d", price.Type, price.ID, price.Count)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// importMerchantData makes the merchant tables match the given merchants.
+// Merchants are keyed by name and offerings by merchant, type, item, count and
+// price list, so importing the same data twice changes nothing, and rows keep
+// their IDs as long as they are listed.
+func importMerchantData(db *sqlx.DB, merchants []Merchant) (MerchantImportReport, error) {
+	var report MerchantImportReport
+	tx, err := db.Beginx()
+	if err != nil {
+		return report, err
+	}
+	report, err = importMerchantDataTx(tx, merchants)
+	if err != nil {
+		tx.Rollback()
+		return MerchantImportReport{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return MerchantImportReport{}, err
+	}
+	return report, nil
+}
+
+func importMerchantDataTx(tx *sqlx.Tx, merchants []Merchant) (MerchantImportReport, error) {
+	var report MerchantImportReport
+	var existingMerchants []struct {
+		ID          int            `db:"id"`
+		Name        string         `db:"name"`
+		Locations   string         `db:"locations"`
+		DisplayName sql.NullString `db:"display_name"`
+	}
+	if err := tx.Select(&existingMerchants, "SELECT id, name, locations, display_name FROM merchants"); err != nil {
+		return report, fmt.Errorf("Failed to load cached merchants: %w", err)
+	}
+	merchantIDs := make(map[string]int, len(existingMerchants))
+	for _, existing := range existingMerchants {
+		merchantIDs[existing.Name] = existing.ID
+	}
+
+	type offeringKey struct {
+		merchantID int
+		offerType  string
+		itemID     int
+		count      int
+		priceKey   string
+	}
+	var existingOfferings []struct {
+		ID         int    `db:"id"`
+		MerchantID int    `db:"merchant_id"`
+		Type       string `db:"type"`
+		ItemID     int    `db:"item_id"`
+		Count      int    `db:"count"`
+		PriceKey   string `db:"price_key"`
+		Ignore     bool   `db:"ignore"`
+	}
+	err := tx.Select(&existingOfferings, "SELECT id, merchant_id, type, item_id, count, price_key, ignore FROM purchase_options")
+	if err != nil {
+		return report, fmt.Errorf("Failed to load cached merchant offerings: %w", err)
+	}
+	type offering struct {
+		id     int
+		ignore bool
+	}
+	offerings := make(map[offeringKey]offering, len(existingOfferings))
+	for _, existing := range existingOfferings {
+		key := offeringKey{existing.MerchantID, existing.Type, existing.ItemID, existing.Count, existing.PriceKey}
+		offerings[key] = offering{existing.ID, existing.Ignore}
+	}
+
+	listedMerchants := make(map[int]bool)
+	listedOfferings := make(map[offeringKey]bool)
+	for _, merchant := range merchants {
+		locations := strings.Join(merchant.Locations, ",")
+		displayName := sql.NullString{String: merchant.DisplayName, Valid: merchant.DisplayName != ""}
+		merchantID, known := merchantIDs[merchant.Name]
+		if known {
+			res, err := tx.Exec(`
+				UPDATE merchants SET locations = ?, display_name = ?
+				WHERE id = ? AND (locations IS NOT ? OR display_name IS NOT ?)
+			`, locations, displayName, merchantID, locations, displayName)
+			if err != nil {
+				return report, fmt.Errorf("Failed to update merchant %s: %w", merchant.Name, err)
+			}
+			if updated, err := res.RowsAffected(); err == nil && updated > 0 {
+				logger.Debug("Updated merchant", "merchant", merchant.Name)
+				report.MerchantsUpdated++
+			}
+		} else {
+			res, err := tx.Exec("INSERT INTO merchants (name, locations, display_name) VALUES (?, ?, ?)", merchant.Name, locations, displayName)
+			if err != nil {
+				return report, fmt.Errorf("Failed to add merchant %s: %w", merchant.Name, err)
+			}
+			id, err := res.LastInsertId()
+			if err != nil {
+				return report, err
+			}
+			merchantID = int(id)
+			merchantIDs[merchant.Name] = merchantID
+			logger.Debug("Added merchant", "merchant", merchant.Name)
+			report.MerchantsAdded++
+		}
+		listedMerchants[merchantID] = true
+
+		for _, option := range merchant.PurchaseOptions {
+			key := offeringKey{merchantID, option.Type, option.ID, option.Count, priceKey(option.Price)}
+			if listedOfferings[key] {
+				logger.Warn("Skipping duplicate merchant offering", "merchant", merchant.Name, "itemID", option.ID, "count", option.Count, "price", key.priceKey)
+				report.Duplicates++
+				continue
+			}
+			listedOfferings[key] = true
+
+			if existing, ok := offerings[key]; ok {
+				if existing.ignore != option.Ignore {
+					_, err := tx.Exec("UPDATE purchase_options SET ignore = ? WHERE id = ?", option.Ignore, existing.id)
+					if err != nil {
+						return report, fmt.Errorf("Failed to update offering of item %d by %s: %w", option.ID, merchant.Name, err)
+					}
+					logger.Debug("Updated merchant offering", "merchant", merchant.Name, "itemID", option.ID, "ignore", option.Ignore)
+					report.OfferingsUpdated++
+				}
+				continue
+			}
+			res, err := tx.Exec(`INSERT INTO purchase_options (type, item_id, count, ignore, merchant_id, price_key) VALUES (?, ?, ?, ?, ?, ?)`,
+				option.Type, option.ID, option.Count, option.Ignore, merchantID, key.priceKey)
+			if err != nil {
+				return report, fmt.Errorf("Failed to add offering of item %d by %s: %w", option.ID, merchant.Name, err)
+			}
+			optionID, err := res.LastInsertId()
+			if err != nil {
+				return report, err
+			}
+			for _, price := range option.Price {
+				_, err := tx.Exec(`INSERT INTO merchant_prices (type, currency_id, count, purchase_option_id) VALUES (?, ?, ?, ?)`,
+					price.Type, price.ID, price.Count, optionID)
+				if err != nil {
+					return report, fmt.Errorf("Failed to add price of item %d by %s: %w", option.ID, merchant.Name, err)
+				}
+			}
+			logger.Debug("Added merchant offering", "merchant", merchant.Name, "itemID", option.ID, "count", option.Count, "price", key.priceKey)
+			report.OfferingsAdded++
+		}
+	}
+
+	for key, existing := range offerings {
+		if listedOfferings[key] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM merchant_prices WHERE purchase_option_id = ?", existing.id); err != nil {
+			return report, fmt.Errorf("Failed to remove prices of offering %d: %w", existing.id, err)
+		}
+		if _, err := tx.Exec("DELETE FROM purchase_options WHERE id = ?", existing.id); err != nil {
+			return report, fmt.Errorf("Failed to remove offering %d: %w", existing.id, err)
+		}
+		logger.Debug("Removed merchant offering", "merchantID", key.merchantID, "itemID", key.itemID, "count", key.count, "price", key.priceKey)
+		report.OfferingsRemoved++
+	}
+	for _, existing := range existingMerchants {
+		if listedMerchants[existing.ID] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM merchants WHERE id = ?", existing.ID); err != nil {
+			return report, fmt.Errorf("Failed to remove merchant %s: %w", existing.Name, err)
+		}
+		logger.Debug("Removed merchant", "merchant", existing.Name)
+		report.MerchantsRemoved++
+	}
+	return report, nil
+}
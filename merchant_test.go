@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestImportMerchantData(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+
+	ore := MerchantOptions{Type: "Item", ID: 10, Count: 1, Price: []MerchantPrice{{Type: "Currency", ID: 1, Count: 50}}}
+	oreForKarma := MerchantOptions{Type: "Item", ID: 10, Count: 1, Price: []MerchantPrice{{Type: "Currency", ID: 2, Count: 80}}}
+	ingot := MerchantOptions{Type: "Item", ID: 20, Count: 5, Price: []MerchantPrice{{Type: "Currency", ID: 1, Count: 100}, {Type: "Item", ID: 10, Count: 2}}}
+	// The same price list in a different order is the same offering
+	ingotReordered := MerchantOptions{Type: "Item", ID: 20, Count: 5, Price: []MerchantPrice{{Type: "Item", ID: 10, Count: 2}, {Type: "Currency", ID: 1, Count: 100}}}
+	miyani := Merchant{Name: "Miyani", Locations: StringSlice{"Lion's Arch"}, PurchaseOptions: []MerchantOptions{ore, oreForKarma, ingot, ingotReordered}}
+	gleam := Merchant{Name: "Gleam", Locations: StringSlice{"Mistlock"}, PurchaseOptions: []MerchantOptions{ore}}
+
+	offeringIDs := func() map[int]int {
+		t.Helper()
+		var rows []struct {
+			ID     int `db:"id"`
+			ItemID int `db:"item_id"`
+		}
+		if err := db.Select(&rows, "SELECT po.id, po.item_id FROM purchase_options po JOIN merchants m ON m.id = po.merchant_id WHERE m.name = 'Miyani' AND po.price_key NOT LIKE '%Currency:2:%'"); err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[int]int)
+		for _, row := range rows {
+			ids[row.ItemID] = row.ID
+		}
+		return ids
+	}
+	count := func(query string) int {
+		t.Helper()
+		var n int
+		if err := db.Get(&n, query); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	movedMiyani := miyani
+	movedMiyani.Locations = StringSlice{"Mystic Forge"}
+	ignoredIngot := ingot
+	ignoredIngot.Ignore = true
+	movedMiyani.PurchaseOptions = []MerchantOptions{ore, ignoredIngot}
+
+	var firstIDs map[int]int
+	tests := []struct {
+		name      string
+		merchants []Merchant
+		want      MerchantImportReport
+		offerings int
+		prices    int
+	}{
+		{"First import adds everything once", []Merchant{miyani, gleam},
+			MerchantImportReport{MerchantsAdded: 2, OfferingsAdded: 4, Duplicates: 1}, 4, 5},
+		{"Importing the same data changes nothing", []Merchant{gleam, miyani},
+			MerchantImportReport{Duplicates: 1}, 4, 5},
+		{"Changes, removed offerings and removed merchants", []Merchant{movedMiyani},
+			MerchantImportReport{MerchantsUpdated: 1, MerchantsRemoved: 1, OfferingsUpdated: 1, OfferingsRemoved: 2}, 2, 3},
+	}
+	for _, tt := range tests {
+		report, err := importMerchantData(db, tt.merchants)
+		if err != nil {
+			t.Fatalf("%s: importMerchantData() returned error: %v", tt.name, err)
+		}
+		if report != tt.want {
+			t.Errorf("%s: importMerchantData() = %+v, want %+v", tt.name, report, tt.want)
+		}
+		if got := count("SELECT COUNT(*) FROM purchase_options"); got != tt.offerings {
+			t.Errorf("%s: %d offerings cached, want %d", tt.name, got, tt.offerings)
+		}
+		if got := count("SELECT COUNT(*) FROM merchant_prices"); got != tt.prices {
+			t.Errorf("%s: %d prices cached, want %d", tt.name, got, tt.prices)
+		}
+		// Offerings that are still listed keep their IDs
+		ids := offeringIDs()
+		if firstIDs == nil {
+			firstIDs = ids
+		} else if ids[10] != firstIDs[10] || ids[20] != firstIDs[20] {
+			t.Errorf("%s: offering IDs changed from %v to %v", tt.name, firstIDs, ids)
+		}
+	}
+	if got := count("SELECT COUNT(*) FROM purchase_options WHERE ignore"); got != 1 {
+		t.Errorf("%d ignored offerings, want 1", got)
+	}
+	if got := count("SELECT COUNT(*) FROM merchants WHERE locations = 'Mystic Forge'"); got != 1 {
+		t.Error("Merchant locations were not updated")
+	}
+}
+
+func TestImportMerchantDataFileIsIdempotent(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	merchants, err := ParseMerchantDataFile(merchantDataFile)
+	if err != nil {
+		t.Fatalf("ParseMerchantDataFile() returned error: %v", err)
+	}
+	if _, err := importMerchantData(db, merchants); err != nil {
+		t.Fatalf("importMerchantData() returned error: %v", err)
+	}
+	report, err := importMerchantData(db, merchants)
+	if err != nil {
+		t.Fatalf("Second importMerchantData() returned error: %v", err)
+	}
+	if report.Changed() {
+		t.Errorf("Importing %s twice changed the cache: %+v", merchantDataFile, report)
+	}
+}
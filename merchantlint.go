@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MerchantDataIssue is a problem found in the merchant data file
+type MerchantDataIssue struct {
+	Line     int
+	Merchant string
+	Warning  bool // the data still imports correctly
+	Message  string
+}
+
+func (issue MerchantDataIssue) String() string {
+	if issue.Merchant == "" {
+		return fmt.Sprintf("line %d: %s", issue.Line, issue.Message)
+	}
+	return fmt.Sprintf("line %d: %s: %s", issue.Line, issue.Merchant, issue.Message)
+}
+
+// A jsonElement is a raw JSON value with its byte offset in the file
+type jsonElement struct {
+	raw    json.RawMessage
+	offset int
+}
+
+// LintMerchantDataFile checks a merchant data file against the cached items
+// and currencies
+func (lc *LocalCache) LintMerchantDataFile(path string) ([]MerchantDataIssue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var itemIds, currencyIds []int
+	if err := lc.db.Select(&itemIds, "SELECT id FROM items"); err != nil {
+		return nil, fmt.Errorf("Failed to load cached items: %w", err)
+	}
+	if err := lc.db.Select(&currencyIds, "SELECT id FROM currencies"); err != nil {
+		return nil, fmt.Errorf("Failed to load cached currencies: %w", err)
+	}
+	return lintMerchantData(data, idSet(itemIds), idSet(currencyIds)), nil
+}
+
+// lintMerchantData validates merchant data, reporting every problem with the
+// line it starts on. Unlike ParseMerchantDataFile it rejects unknown fields,
+// which are usually misspelled keys.
+func lintMerchantData(data []byte, knownItems, knownCurrencies map[int]bool) []MerchantDataIssue {
+	var issues []MerchantDataIssue
+	report := func(offset int, merchant string, warning bool, format string, args ...interface{}) {
+		issues = append(issues, MerchantDataIssue{Line: lineAt(data, offset), Merchant: merchant, Warning: warning, Message: fmt.Sprintf(format, args...)})
+	}
+
+	merchantElements, err := jsonArrayElements(data, 0)
+	if err != nil {
+		report(jsonErrorOffset(err), "", false, "Invalid merchant data: %v", err)
+		return issues
+	}
+	merchantLines := make(map[string]int)
+	for _, element := range merchantElements {
+		var merchant Merchant
+		decoder := json.NewDecoder(bytes.NewReader(element.raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&merchant); err != nil {
+			report(element.offset+jsonErrorOffset(err), merchant.Name, false, "Invalid merchant: %v", err)
+			continue
+		}
+		if merchant.Name == "" {
+			report(element.offset, "", false, "Merchant has no name")
+		} else if line, ok := merchantLines[merchant.Name]; ok {
+			report(element.offset, merchant.Name, false, "Merchant is already listed on line %d", line)
+		} else {
+			merchantLines[merchant.Name] = lineAt(data, element.offset)
+		}
+		if len(merchant.Locations) == 0 {
+			report(element.offset, merchant.Name, false, "Merchant has no locations")
+		}
+		if len(merchant.DisplayLocations) == 0 {
+			report(element.offset, merchant.Name, true, "Merchant has no display_locations")
+		}
+
+		if len(merchant.PurchaseOptions) == 0 {
+			report(element.offset, merchant.Name, true, "Merchant has no purchase_options")
+			continue
+		}
+		optionElements, err := jsonFieldArrayElements(element, "purchase_options")
+		if err != nil {
+			report(element.offset, merchant.Name, false, "Invalid purchase options: %v", err)
+			continue
+		}
+		if len(optionElements) != len(merchant.PurchaseOptions) {
+			report(element.offset, merchant.Name, false, "Cannot locate the %d purchase options, found %d", len(merchant.PurchaseOptions), len(optionElements))
+			continue
+		}
+		optionLines := make(map[string]int)
+		for i, option := range merchant.PurchaseOptions {
+			optionOffset := optionElements[i].offset
+			switch {
+			case option.Type != "Item":
+				report(optionOffset, merchant.Name, false, "Unknown offering type %q", option.Type)
+			case !knownItems[option.ID]:
+				report(optionOffset, merchant.Name, false, "Offered item %d does not exist", option.ID)
+			}
+			if option.Count <= 0 {
+				report(optionOffset, merchant.Name, false, "Offering of item %d has count %d", option.ID, option.Count)
+			}
+			key := fmt.Sprintf("%s:%d:%d:%s", option.Type, option.ID, option.Count, priceKey(option.Price))
+			if line, ok := optionLines[key]; ok {
+				report(optionOffset, merchant.Name, false, "Offering of item %d duplicates the one on line %d", option.ID, line)
+			} else {
+				optionLines[key] = lineAt(data, optionOffset)
+			}
+
+			if len(option.Price) == 0 {
+				report(optionOffset, merchant.Name, false, "Offering of item %d has no price", option.ID)
+				continue
+			}
+			priceElements, err := jsonFieldArrayElements(optionElements[i], "price")
+			if err != nil {
+				report(optionOffset, merchant.Name, false, "Invalid price: %v", err)
+				continue
+			}
+			if len(priceElements) != len(option.Price) {
+				report(optionOffset, merchant.Name, false, "Cannot locate the %d prices of item %d, found %d", len(option.Price), option.ID, len(priceElements))
+				continue
+			}
+			for j, price := range option.Price {
+				priceOffset := priceElements[j].offset
+				switch {
+				case price.Type == "Currency" && !knownCurrencies[price.ID]:
+					report(priceOffset, merchant.Name, false, "Price of item %d uses unknown currency %d", option.ID, price.ID)
+				case price.Type == "Item" && !knownItems[price.ID]:
+					report(priceOffset, merchant.Name, false, "Price of item %d uses item %d, which does not exist", option.ID, price.ID)
+				case price.Type != "Currency" && price.Type != "Item":
+					report(priceOffset, merchant.Name, false, "Price of item %d has unknown type %q", option.ID, price.Type)
+				}
+				if price.Count <= 0 {
+					report(priceOffset, merchant.Name, false, "Price of item %d has count %d", option.ID, price.Count)
+				}
+			}
+		}
+	}
+	return issues
+}
+
+// jsonArrayElements splits a JSON array into its elements. offset is the
+// position of data in the file and is added to every element offset.
+func jsonArrayElements(data []byte, offset int) ([]jsonElement, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := expectDelim(decoder, '['); err != nil {
+		return nil, err
+	}
+	var elements []jsonElement
+	for decoder.More() {
+		start := int(decoder.InputOffset())
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		elements = append(elements, jsonElement{raw: raw, offset: offset + skipJSONSeparators(data, start)})
+	}
+	if err := expectDelim(decoder, ']'); err != nil {
+		return nil, err
+	}
+	return elements, nil
+}
+
+// jsonFieldArrayElements splits the array held by a field of a JSON object.
+// Like encoding/json it matches the key case-insensitively and keeps the last
+// occurrence, so the elements line up with the decoded struct.
+func jsonFieldArrayElements(object jsonElement, field string) ([]jsonElement, error) {
+	decoder := json.NewDecoder(bytes.NewReader(object.raw))
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, err
+	}
+	var value json.RawMessage
+	var valueOffset int
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		start := int(decoder.InputOffset())
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if name, ok := key.(string); ok && strings.EqualFold(name, field) {
+			value, valueOffset = raw, object.offset+skipJSONSeparators(object.raw, start)
+		}
+	}
+	if value == nil {
+		return nil, nil
+	}
+	return jsonArrayElements(value, valueOffset)
+}
+
+// skipJSONSeparators returns the offset of the first value byte at or after start
+func skipJSONSeparators(data []byte, start int) int {
+	for start < len(data) && bytes.IndexByte([]byte(" \t\r\n,:"), data[start]) >= 0 {
+		start++
+	}
+	return start
+}
+
+// jsonErrorOffset returns the offset a JSON decoding error points at, if any
+func jsonErrorOffset(err error) int {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return int(syntaxErr.Offset)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return int(typeErr.Offset)
+	}
+	return 0
+}
+
+func lineAt(data []byte, offset int) int {
+	offset = min(max(offset, 0), len(data))
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func idSet(ids []int) map[int]bool {
+	set := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
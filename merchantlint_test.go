@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLintMerchantData(t *testing.T) {
+	knownItems := map[int]bool{1: true, 2: true}
+	knownCurrencies := map[int]bool{23: true}
+	tests := []struct {
+		name string
+		data string
+		want []MerchantDataIssue
+	}{
+		{
+			name: "valid",
+			data: `[
+  {
+    "name": "Miyani",
+    "locations": ["Lion's Arch"],
+    "display_locations": ["Mystic Forge"],
+    "purchase_options": [
+      {"type": "Item", "id": 1, "count": 1, "price": [{"type": "Currency", "id": 23, "count": 200}]},
+      {"type": "Item", "id": 2, "count": 1, "price": [{"type": "Item", "id": 1, "count": 3}]}
+    ]
+  }
+]`,
+		},
+		{
+			name: "unknown ids and zero counts",
+			data: `[
+  {
+    "name": "Miyani",
+    "locations": ["Lion's Arch"],
+    "display_locations": ["Mystic Forge"],
+    "purchase_options": [
+      {"type": "Item", "id": 9, "count": 0,
+       "price": [
+         {"type": "Currency", "id": 99, "count": 200},
+         {"type": "Item", "id": 8, "count": 0}
+       ]}
+    ]
+  }
+]`,
+			want: []MerchantDataIssue{
+				{Line: 7, Merchant: "Miyani", Message: "Offered item 9 does not exist"},
+				{Line: 7, Merchant: "Miyani", Message: "Offering of item 9 has count 0"},
+				{Line: 9, Merchant: "Miyani", Message: "Price of item 9 uses unknown currency 99"},
+				{Line: 10, Merchant: "Miyani", Message: "Price of item 9 uses item 8, which does not exist"},
+				{Line: 10, Merchant: "Miyani", Message: "Price of item 9 has count 0"},
+			},
+		},
+		{
+			name: "duplicates and missing fields",
+			data: `[
+  {"name": "Miyani", "locations": ["Lion's Arch"], "display_locations": ["Mystic Forge"],
+   "purchase_options": [
+     {"type": "Item", "id": 1, "count": 1, "price": [{"type": "Currency", "id": 23, "count": 1}]},
+     {"type": "Item", "id": 1, "count": 1, "price": [{"type": "Currency", "id": 23, "count": 1}]},
+     {"type": "Item", "id": 2, "count": 1}
+   ]},
+  {"name": "Miyani", "locations": [], "purchase_options": []}
+]`,
+			want: []MerchantDataIssue{
+				{Line: 5, Merchant: "Miyani", Message: "Offering of item 1 duplicates the one on line 4"},
+				{Line: 6, Merchant: "Miyani", Message: "Offering of item 2 has no price"},
+				{Line: 8, Merchant: "Miyani", Message: "Merchant is already listed on line 2"},
+				{Line: 8, Merchant: "Miyani", Message: "Merchant has no locations"},
+				{Line: 8, Merchant: "Miyani", Warning: true, Message: "Merchant has no display_locations"},
+				{Line: 8, Merchant: "Miyani", Warning: true, Message: "Merchant has no purchase_options"},
+			},
+		},
+		{
+			name: "keys match case-insensitively",
+			data: `[
+  {"name": "Miyani", "locations": ["Lion's Arch"], "display_locations": ["Mystic Forge"],
+   "Purchase_Options": [
+     {"type": "Item", "id": 9, "count": 1,
+      "Price": [{"type": "Currency", "id": 99, "count": 1}]}
+   ]}
+]`,
+			want: []MerchantDataIssue{
+				{Line: 4, Merchant: "Miyani", Message: "Offered item 9 does not exist"},
+				{Line: 5, Merchant: "Miyani", Message: "Price of item 9 uses unknown currency 99"},
+			},
+		},
+		{
+			name: "duplicated key keeps the last value",
+			data: `[
+  {"name": "Miyani", "locations": ["Lion's Arch"], "display_locations": ["Mystic Forge"],
+   "purchase_options": [
+     {"type": "Item", "id": 1, "count": 1, "price": [{"type": "Currency", "id": 23, "count": 1}]}
+   ],
+   "purchase_options": [
+     {"type": "Item", "id": 1, "count": 1, "price": [{"type": "Currency", "id": 23, "count": 1}]},
+     {"type": "Item", "id": 9, "count": 1,
+      "price": [{"type": "Currency", "id": 23, "count": 1}],
+      "price": [{"type": "Currency", "id": 23, "count": 1}, {"type": "Currency", "id": 99, "count": 1}]}
+   ]}
+]`,
+			want: []MerchantDataIssue{
+				{Line: 8, Merchant: "Miyani", Message: "Offered item 9 does not exist"},
+				{Line: 10, Merchant: "Miyani", Message: "Price of item 9 uses unknown currency 99"},
+			},
+		},
+		{
+			name: "unknown field",
+			data: `[
+  {"name": "Miyani", "locations": ["Lion's Arch"], "display_locations": ["Mystic Forge"],
+   "purchase_option": []}
+]`,
+			want: []MerchantDataIssue{
+				{Line: 2, Merchant: "Miyani", Message: `Invalid merchant: json: unknown field "purchase_option"`},
+			},
+		},
+		{
+			name: "syntax error",
+			data: "[\n  {\"name\": \"Miyani\",}\n]",
+			want: []MerchantDataIssue{
+				{Line: 2, Message: "Invalid merchant data: invalid character '}' looking for beginning of object key string"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := lintMerchantData([]byte(test.data), knownItems, knownCurrencies)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("lintMerchantData() =\n%s\nwant\n%s", formatIssues(got), formatIssues(test.want))
+			}
+		})
+	}
+}
+
+func formatIssues(issues []MerchantDataIssue) string {
+	lines := make([]string, len(issues))
+	for i, issue := range issues {
+		lines[i] = issue.String()
+	}
+	return strings.Join(lines, "\n")
+}
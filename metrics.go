@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram; slower requests
+// fall in a final overflow bucket
+var latencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// A LatencyHistogram counts requests per latency bucket. Counts has one more
+// entry than Buckets for requests slower than the last bound.
+type LatencyHistogram struct {
+	Buckets []time.Duration
+	Counts  []int
+}
+
+func newLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{Buckets: latencyBuckets, Counts: make([]int, len(latencyBuckets)+1)}
+}
+
+func (h *LatencyHistogram) observe(latency time.Duration) {
+	for i, bound := range h.Buckets {
+		if latency <= bound {
+			h.Counts[i]++
+			return
+		}
+	}
+	h.Counts[len(h.Buckets)]++
+}
+
+func (h LatencyHistogram) String() string {
+	parts := make([]string, 0, len(h.Counts))
+	for i, count := range h.Counts {
+		if count == 0 {
+			continue
+		}
+		if i < len(h.Buckets) {
+			parts = append(parts, fmt.Sprintf("<=%s:%d", h.Buckets[i], count))
+		} else {
+			parts = append(parts, fmt.Sprintf(">%s:%d", h.Buckets[len(h.Buckets)-1], count))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// EndpointStats are the request metrics of one endpoint
+type EndpointStats struct {
+	Endpoint     string
+	Requests     int         // requests sent, including retries
+	Failures     int         // requests that got no response at all
+	Retries      int         // requests repeated after a retriable error
+	StatusCodes  map[int]int // responses per status code
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+	Latency      LatencyHistogram
+}
+
+// MeanLatency returns the average latency of the requests that were sent
+func (stats EndpointStats) MeanLatency() time.Duration {
+	if stats.Requests == 0 {
+		return 0
+	}
+	return stats.TotalLatency / time.Duration(stats.Requests)
+}
+
+// RequestMetrics collects per-endpoint request metrics. It is safe for
+// concurrent use and can be shared between clients to report a whole run.
+type RequestMetrics struct {
+	mu        sync.Mutex
+	endpoints map[string]*EndpointStats
+}
+
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{endpoints: make(map[string]*EndpointStats)}
+}
+
+var numericPathSegment = regexp.MustCompile(`/\d+(/|$)`)
+
+// endpointKey groups requests by path, dropping the query string and
+// collapsing numeric IDs so /commerce/prices/123 and /commerce/prices/456 match
+func endpointKey(endpoint string) string {
+	path, _, _ := strings.Cut(endpoint, "?")
+	// Matches share their trailing slash, so collapse until nothing changes
+	for {
+		collapsed := numericPathSegment.ReplaceAllString(path, "/:id$1")
+		if collapsed == path {
+			return path
+		}
+		path = collapsed
+	}
+}
+
+func (metrics *RequestMetrics) statsFor(endpoint string) *EndpointStats {
+	key := endpointKey(endpoint)
+	stats, ok := metrics.endpoints[key]
+	if !ok {
+		stats = &EndpointStats{Endpoint: key, StatusCodes: make(map[int]int), Latency: newLatencyHistogram()}
+		metrics.endpoints[key] = stats
+	}
+	return stats
+}
+
+// recordRequest records a sent request; statusCode is 0 when no response was received
+func (metrics *RequestMetrics) recordRequest(endpoint string, statusCode int, latency time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	stats := metrics.statsFor(endpoint)
+	stats.Requests++
+	if statusCode == 0 {
+		stats.Failures++
+	} else {
+		stats.StatusCodes[statusCode]++
+	}
+	stats.TotalLatency += latency
+	stats.MaxLatency = max(stats.MaxLatency, latency)
+	stats.Latency.observe(latency)
+}
+
+// recordRetry records that a request to endpoint is about to be repeated
+func (metrics *RequestMetrics) recordRetry(endpoint string) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.statsFor(endpoint).Retries++
+}
+
+// Stats returns a snapshot of the metrics, busiest endpoint first
+func (metrics *RequestMetrics) Stats() []EndpointStats {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	snapshot := make([]EndpointStats, 0, len(metrics.endpoints))
+	for _, stats := range metrics.endpoints {
+		statsCopy := *stats
+		statsCopy.StatusCodes = make(map[int]int, len(stats.StatusCodes))
+		for code, count := range stats.StatusCodes {
+			statsCopy.StatusCodes[code] = count
+		}
+		statsCopy.Latency.Counts = append([]int(nil), stats.Latency.Counts...)
+		snapshot = append(snapshot, statsCopy)
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		if snapshot[i].Requests != snapshot[j].Requests {
+			return snapshot[i].Requests > snapshot[j].Requests
+		}
+		return snapshot[i].Endpoint < snapshot[j].Endpoint
+	})
+	return snapshot
+}
+
+// LogStats logs one line per endpoint with its request metrics
+func (metrics *RequestMetrics) LogStats() {
+	for _, stats := range metrics.Stats() {
+		logger.Info("API request stats", "endpoint", stats.Endpoint, "requests", stats.Requests, "retries", stats.Retries, "failures", stats.Failures, "statusCodes", stats.StatusCodes, "meanLatency", stats.MeanLatency().String(), "maxLatency", stats.MaxLatency.String(), "latency", stats.Latency.String())
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
+)
+
+func TestEndpointKey(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{"/items?ids=1,2,3", "/items"},
+		{"/commerce/prices/19718", "/commerce/prices/:id"},
+		{"/guild/123/456", "/guild/:id/:id"},
+		{"/commerce/exchange/coins?quantity=100", "/commerce/exchange/coins"},
+		{"/v2b/items", "/v2b/items"},
+	}
+	for _, tt := range tests {
+		if got := endpointKey(tt.endpoint); got != tt.want {
+			t.Errorf("endpointKey(%q) = %q, want %q", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	histogram := newLatencyHistogram()
+	for _, latency := range []time.Duration{10 * time.Millisecond, 50 * time.Millisecond, 300 * time.Millisecond, 10 * time.Second} {
+		histogram.observe(latency)
+	}
+	want := []int{2, 0, 0, 1, 0, 0, 0, 1}
+	if !reflect.DeepEqual(histogram.Counts, want) {
+		t.Errorf("Counts = %v, want %v", histogram.Counts, want)
+	}
+	if got := histogram.String(); got != "<=50ms:2 <=500ms:1 >5s:1" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func TestAPIClientStats(t *testing.T) {
+	fake := fakeapi.New()
+	if err := fake.AddPrices(ItemPrice{ID: 10}, ItemPrice{ID: 20}); err != nil {
+		t.Fatalf("Failed to seed prices: %v", err)
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	metrics := NewRequestMetrics()
+	client := NewAPIClient(server.URL, "token", WithRequestMetrics(metrics))
+	other := NewAPIClient(server.URL, "other", WithRequestMetrics(metrics))
+	for _, itemID := range []int{10, 20} {
+		if _, err := client.FetchItemPrice(itemID); err != nil {
+			t.Fatalf("FetchItemPrice(%d) returned error: %v", itemID, err)
+		}
+	}
+	if _, err := other.FetchItemPrice(30); err == nil {
+		t.Fatal("FetchItemPrice(30) returned no error for an unknown item")
+	}
+	if _, err := client.FetchAllIds("/items"); err != nil {
+		t.Fatalf("FetchAllIds() returned error: %v", err)
+	}
+	metrics.recordRetry("/items")
+
+	stats := client.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("Stats() returned %+v, want 2 endpoints", stats)
+	}
+	prices := stats[0]
+	if prices.Endpoint != "/commerce/prices/:id" || prices.Requests != 3 || !reflect.DeepEqual(prices.StatusCodes, map[int]int{200: 2, 404: 1}) {
+		t.Errorf("Price stats = %+v, want 3 requests with two 200s and one 404", prices)
+	}
+	if total := sum(prices.Latency.Counts); total != 3 {
+		t.Errorf("Price latency histogram holds %d requests, want 3", total)
+	}
+	items := stats[1]
+	if items.Endpoint != "/items" || items.Requests != 1 || items.Retries != 1 {
+		t.Errorf("Item stats = %+v, want 1 request and 1 retry", items)
+	}
+}
+
+func sum(values []int) int {
+	total := 0
+	for _, value := range values {
+		total += value
+	}
+	return total
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A migration moves the local cache schema from version-1 to version. Each one
+// runs in its own transaction together with its schema_version record.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sqlx.Tx) error
+}
+
+// migrations are applied in order; append new ones instead of editing applied ones
+var migrations = []migration{
+	{1, "Create the cache tables", createBaselineSchema},
+	{2, "Upgrade caches created before schema versioning", upgradeUnversionedCache},
+	{3, "Track known IDs for incremental refreshes", addIncrementalRefreshTables},
+	{4, "Track refreshes per dataset", addDatasetMetadataTable},
+	{5, "Record Trading Post price history", addPriceHistoryTable},
+	{6, "Key merchant offerings by their natural keys", addMerchantNaturalKeys},
+	{7, "Track which items refresh the search index holds", addSearchIndexedColumn},
+}
+
+// latestSchemaVersion is the schema version this build of the tool expects
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrateCache brings the local cache schema up to date, refusing caches
+// written by a newer version of the tool
+func migrateCache(db *sqlx.DB) error {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_version (
+      version INTEGER PRIMARY KEY,
+      description TEXT NOT NULL,
+      applied_at TIMESTAMP NOT NULL
+    );
+  `)
+	if err != nil {
+		return fmt.Errorf("Failed to create schema version table: %w", err)
+	}
+	currentVersion, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if currentVersion > latestSchemaVersion() {
+		return fmt.Errorf("Local cache schema version %d is newer than the supported version %d, update the tool or delete the cache", currentVersion, latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= currentVersion {
+			continue
+		}
+		logger.Info("Migrating local cache schema", "version", m.version, "description", m.description)
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to apply cache migration %d (%s): %w", m.version, m.description, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)", m.version, m.description, time.Now().UTC())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to record cache migration %d: %w", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("Failed to commit cache migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// schemaVersion returns the latest applied migration, 0 for a new or unversioned cache
+func schemaVersion(db *sqlx.DB) (int, error) {
+	var version int
+	err := db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to query cache schema version: %w", err)
+	}
+	return version, nil
+}
+
+// createBaselineSchema creates every table that existed when schema versioning
+// was introduced. Tables are created only when missing, since caches from
+// before versioning already have some of them.
+func createBaselineSchema(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+    CREATE TABLE IF NOT EXISTS metadata (
+      build_number INTEGER PRIMARY KEY
+    );
+
+    CREATE TABLE IF NOT EXISTS recipes (
+      id INTEGER PRIMARY KEY,
+      type TEXT,
+      output_item_id INTEGER,
+      output_item_count INTEGER,
+      disciplines TEXT,
+      min_rating INTEGER,
+      flags TEXT,
+      output_upgrade_id INTEGER NOT NULL DEFAULT 0
+    );
+
+    CREATE TABLE IF NOT EXISTS ingredients (
+      id INTEGER PRIMARY KEY,
+      item_id INTEGER,
+      count INTEGER,
+      recipe_id INTEGER,
+      FOREIGN KEY(recipe_id) REFERENCES recipes(id),
+      UNIQUE(item_id, recipe_id)
+    );
+
+    CREATE TABLE IF NOT EXISTS guild_ingredients (
+      id INTEGER PRIMARY KEY,
+      upgrade_id INTEGER,
+      count INTEGER,
+      recipe_id INTEGER,
+      FOREIGN KEY(recipe_id) REFERENCES recipes(id),
+      UNIQUE(upgrade_id, recipe_id)
+    );
+
+    CREATE TABLE IF NOT EXISTS items (
+      id INTEGER PRIMARY KEY,
+      name TEXT,
+      type TEXT,
+      rarity TEXT,
+      vendor_value INTEGER,
+      flags TEXT,
+      level INTEGER NOT NULL DEFAULT 0,
+      description TEXT NOT NULL DEFAULT '',
+      chat_link TEXT NOT NULL DEFAULT '',
+      restrictions TEXT NOT NULL DEFAULT '',
+      details TEXT,
+      upgrades_into TEXT,
+      upgrades_from TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS tradeable_items (
+      id INTEGER PRIMARY KEY
+    );
+
+    CREATE TABLE IF NOT EXISTS currencies (
+      id INTEGER PRIMARY KEY,
+      name TEXT,
+      description TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS merchants (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      name TEXT NOT NULL,
+      locations TEXT NOT NULL,
+      display_name TEXT
+    );
+
+    CREATE TABLE IF NOT EXISTS purchase_options (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      type TEXT NOT NULL,
+      item_id INTEGER NOT NULL,
+      count INTEGER NOT NULL,
+      ignore BOOLEAN NOT NULL,
+      merchant_id INTEGER,
+      FOREIGN KEY (merchant_id) REFERENCES merchants (id)
+    );
+
+    CREATE TABLE IF NOT EXISTS merchant_prices (
+      id INTEGER PRIMARY KEY AUTOINCREMENT,
+      type TEXT NOT NULL,
+      currency_id INTEGER NOT NULL,
+      count INTEGER NOT NULL,
+      purchase_option_id INTEGER,
+      FOREIGN KEY (purchase_option_id) REFERENCES purchase_options (id)
+    );
+
+    CREATE TABLE IF NOT EXISTS guild_upgrades (
+      id INTEGER PRIMARY KEY,
+      name TEXT,
+      description TEXT,
+      type TEXT,
+      required_level INTEGER
+    );
+
+    CREATE TABLE IF NOT EXISTS guild_upgrade_costs (
+      id INTEGER PRIMARY KEY,
+      upgrade_id INTEGER NOT NULL,
+      type TEXT,
+      name TEXT,
+      count INTEGER,
+      item_id INTEGER,
+      FOREIGN KEY(upgrade_id) REFERENCES guild_upgrades(id)
+    );
+
+    CREATE TABLE IF NOT EXISTS material_categories (
+      id INTEGER PRIMARY KEY,
+      name TEXT NOT NULL,
+      sort_order INTEGER
+    );
+
+    CREATE TABLE IF NOT EXISTS material_category_items (
+      category_id INTEGER NOT NULL,
+      item_id INTEGER NOT NULL,
+      PRIMARY KEY (category_id, item_id),
+      FOREIGN KEY(category_id) REFERENCES material_categories(id)
+    );
+
+    CREATE TABLE IF NOT EXISTS daily_crafting (
+      recipe_id INTEGER PRIMARY KEY,
+      daily_id TEXT NOT NULL
+    );
+
+    CREATE TABLE IF NOT EXISTS transactions (
+      id INTEGER NOT NULL,
+      side TEXT NOT NULL,
+      item_id INTEGER,
+      price INTEGER,
+      quantity INTEGER,
+      created TIMESTAMP,
+      purchased TIMESTAMP,
+      PRIMARY KEY (id, side)
+    );
+    CREATE INDEX IF NOT EXISTS idx_transactions_purchased ON transactions (side, purchased);
+  `)
+	if err != nil {
+		return err
+	}
+	// The build number is only ever updated, so the row has to exist
+	_, err = tx.Exec("INSERT INTO metadata (build_number) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM metadata)")
+	return err
+}
+
+// upgradeUnversionedCache adds the columns introduced before schema versioning
+// to caches whose tables were created without them
+func upgradeUnversionedCache(tx *sqlx.Tx) error {
+	err := addMissingColumns(tx, "recipes", []string{"output_upgrade_id INTEGER NOT NULL DEFAULT 0"})
+	if err != nil {
+		return err
+	}
+	err = addMissingColumns(tx, "items", []string{
+		"level INTEGER NOT NULL DEFAULT 0",
+		"description TEXT NOT NULL DEFAULT ''",
+		"chat_link TEXT NOT NULL DEFAULT ''",
+		"restrictions TEXT NOT NULL DEFAULT ''",
+		"details TEXT",
+		"upgrades_into TEXT",
+		"upgrades_from TEXT",
+	})
+	if err != nil {
+		return err
+	}
+	// Depends on the level column, so it cannot be part of the baseline
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS idx_items_type_rarity_level ON items (type, rarity, level)")
+	return err
+}
+
+// addIncrementalRefreshTables records which IDs each dataset has seen so
+// refreshes between full refreshes only fetch new ones
+func addIncrementalRefreshTables(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+    CREATE TABLE known_ids (
+      dataset TEXT NOT NULL,
+      id INTEGER NOT NULL,
+      first_build INTEGER NOT NULL,
+      PRIMARY KEY (dataset, id)
+    );
+
+    CREATE TABLE deleted_ids (
+      dataset TEXT NOT NULL,
+      id INTEGER NOT NULL,
+      build_number INTEGER NOT NULL,
+      PRIMARY KEY (dataset, id, build_number)
+    );
+
+    ALTER TABLE metadata ADD COLUMN last_full_refresh TIMESTAMP;
+  `)
+	return err
+}
+
+// addDatasetMetadataTable records when each dataset was last refreshed and how
+// long it stays fresh within a build
+func addDatasetMetadataTable(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+    CREATE TABLE dataset_metadata (
+      dataset TEXT PRIMARY KEY,
+      last_refreshed TIMESTAMP,
+      ttl_seconds INTEGER NOT NULL
+    );
+  `)
+	return err
+}
+
+// addPriceHistoryTable stores price snapshots. Like transactions, they are
+// account history and never replaced by a cache refresh.
+func addPriceHistoryTable(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+    CREATE TABLE price_history (
+      item_id INTEGER NOT NULL,
+      recorded_at TIMESTAMP NOT NULL,
+      buy_price INTEGER NOT NULL,
+      buy_quantity INTEGER NOT NULL,
+      sell_price INTEGER NOT NULL,
+      sell_quantity INTEGER NOT NULL,
+      PRIMARY KEY (item_id, recorded_at)
+    );
+  `)
+	return err
+}
+
+// addMerchantNaturalKeys makes merchant imports idempotent. Earlier imports
+// duplicated every offering, so the merchant tables are cleared and reloaded
+// by the next refresh instead of deduplicated.
+func addMerchantNaturalKeys(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+    DELETE FROM merchant_prices;
+    DELETE FROM purchase_options;
+    DELETE FROM merchants;
+
+    ALTER TABLE purchase_options ADD COLUMN price_key TEXT NOT NULL DEFAULT '';
+    CREATE UNIQUE INDEX idx_merchants_name ON merchants (name);
+    CREATE UNIQUE INDEX idx_purchase_options_key ON purchase_options (merchant_id, type, item_id, count, price_key);
+    CREATE INDEX idx_merchant_prices_option ON merchant_prices (purchase_option_id);
+
+    UPDATE dataset_metadata SET last_refreshed = NULL WHERE dataset = 'merchants';
+  `)
+	return err
+}
+
+// addSearchIndexedColumn records the items refresh the FTS5 search index was
+// last rebuilt from. Builds without FTS5 refresh items without touching the
+// index, so builds with it compare the two when opening the cache.
+func addSearchIndexedColumn(tx *sqlx.Tx) error {
+	_, err := tx.Exec("ALTER TABLE dataset_metadata ADD COLUMN search_indexed TIMESTAMP")
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestMigrateCache(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestSchemaVersion() {
+		t.Errorf("schemaVersion() = %d, want %d", version, latestSchemaVersion())
+	}
+	buildNumber, err := fetchStoredBuildNumber(db)
+	if err != nil || buildNumber != 0 {
+		t.Errorf("fetchStoredBuildNumber() = %d, %v, want 0 on a new cache", buildNumber, err)
+	}
+
+	// Running again is a no-op
+	if err := migrateCache(db); err != nil {
+		t.Fatalf("migrateCache() on an up to date cache returned error: %v", err)
+	}
+	var applied int
+	if err := db.Get(&applied, "SELECT COUNT(*) FROM schema_version"); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("schema_version has %d rows, want %d", applied, len(migrations))
+	}
+}
+
+func TestMigrateUnversionedCache(t *testing.T) {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Tables as created before item details, guild recipes and schema versioning
+	_, err = db.Exec(`
+		CREATE TABLE metadata (build_number INTEGER PRIMARY KEY);
+		INSERT INTO metadata (build_number) VALUES (160000);
+		CREATE TABLE recipes (id INTEGER PRIMARY KEY, type TEXT, output_item_id INTEGER, output_item_count INTEGER, disciplines TEXT, min_rating INTEGER, flags TEXT);
+		INSERT INTO recipes (id, type, output_item_id, output_item_count, disciplines, min_rating, flags) VALUES (1, 'Refinement', 100, 1, 'Chef', 0, '');
+		CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, type TEXT, rarity TEXT, vendor_value INTEGER, flags TEXT);
+		INSERT INTO items (id, name, type, rarity, vendor_value, flags) VALUES (100, 'Bowl of Soup', 'Consumable', 'Fine', 10, '');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create legacy cache: %v", err)
+	}
+
+	if err := migrateCache(db); err != nil {
+		t.Fatalf("migrateCache() returned error: %v", err)
+	}
+
+	buildNumber, err := fetchStoredBuildNumber(db)
+	if err != nil || buildNumber != 160000 {
+		t.Errorf("fetchStoredBuildNumber() = %d, %v, want the existing build 160000", buildNumber, err)
+	}
+	lc := NewLocalCache(db)
+	recipe, err := lc.GetRecipeById(1)
+	if err != nil || recipe.OutputUpgradeID != 0 || recipe.OutputItemID != 100 {
+		t.Errorf("GetRecipeById(1) = %+v, %v, want the legacy recipe with no output upgrade", recipe, err)
+	}
+	item, err := lc.GetItemById(100)
+	if err != nil || item.Name != "Bowl of Soup" || item.Level != 0 {
+		t.Errorf("GetItemById(100) = %+v, %v, want the legacy item at level 0", item, err)
+	}
+}
+
+func TestMigrateRejectsNewerCache(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+
+	_, err := db.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, 'From the future', CURRENT_TIMESTAMP)", latestSchemaVersion()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateCache(db); err == nil {
+		t.Error("migrateCache() accepted a cache with a newer schema version")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// SnapshotPrices records the current Trading Post prices of the given items in
+// the price history, all under the same timestamp. Items that cannot be traded
+// are skipped. It returns the number of prices recorded.
+func SnapshotPrices(client *APIClient, db *sqlx.DB, itemIds []int, recordedAt time.Time) (int, error) {
+	var tradeableIds []int
+	for _, itemID := range itemIds {
+		var tradeable bool
+		err := db.Get(&tradeable, "SELECT EXISTS (SELECT 1 FROM tradeable_items WHERE id = ?)", itemID)
+		if err != nil {
+			return 0, fmt.Errorf("Failed to check if item %d is tradeable: %w", itemID, err)
+		}
+		if !tradeable {
+			logger.Warn("Skipping untradeable item in price snapshot", "itemID", itemID)
+			continue
+		}
+		tradeableIds = append(tradeableIds, itemID)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Preparex(`
+		INSERT OR REPLACE INTO price_history (item_id, recorded_at, buy_price, buy_quantity, sell_price, sell_quantity)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	recorded := 0
+	recordedAt = recordedAt.UTC()
+	err = streamBatchesFromAPI(client, "/commerce/prices", tradeableIds, func(price ItemPrice) error {
+		_, err := stmt.Exec(price.ID, recordedAt, price.Buys.UnitPrice, price.Buys.Quantity, price.Sells.UnitPrice, price.Sells.Quantity)
+		if err != nil {
+			return fmt.Errorf("Failed to record price of item %d: %w", price.ID, err)
+		}
+		recorded++
+		return nil
+	})
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("Failed to snapshot prices: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return recorded, nil
+}
+
+// GetPriceHistory returns the price snapshots of an item recorded within
+// [since, until), oldest first
+func (lc *LocalCache) GetPriceHistory(itemID int, since, until time.Time) ([]PriceSnapshot, error) {
+	var snapshots []PriceSnapshot
+	err := lc.db.Select(&snapshots, `
+		SELECT item_id, recorded_at, buy_price, buy_quantity, sell_price, sell_quantity FROM price_history
+		WHERE item_id = ? AND recorded_at >= ? AND recorded_at < ?
+		ORDER BY recorded_at
+	`, itemID, since.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// GetLatestPrice returns the most recent price snapshot of an item, nil when
+// none was recorded
+func (lc *LocalCache) GetLatestPrice(itemID int) (*PriceSnapshot, error) {
+	var snapshot PriceSnapshot
+	err := lc.db.Get(&snapshot, `
+		SELECT item_id, recorded_at, buy_price, buy_quantity, sell_price, sell_quantity FROM price_history
+		WHERE item_id = ? ORDER BY recorded_at DESC LIMIT 1
+	`, itemID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// GetPriceStats summarizes the price snapshots of an item recorded within
+// [since, until)
+func (lc *LocalCache) GetPriceStats(itemID int, since, until time.Time) (*PriceStats, error) {
+	stats := PriceStats{ItemID: itemID}
+	err := lc.db.Get(&stats, `
+		SELECT ? AS item_id, COUNT(*) AS snapshots,
+			COALESCE(MIN(buy_price), 0) AS min_buy, COALESCE(MAX(buy_price), 0) AS max_buy, COALESCE(AVG(buy_price), 0) AS average_buy,
+			COALESCE(MIN(sell_price), 0) AS min_sell, COALESCE(MAX(sell_price), 0) AS max_sell, COALESCE(AVG(sell_price), 0) AS average_sell
+		FROM price_history
+		WHERE item_id = ? AND recorded_at >= ? AND recorded_at < ?
+	`, itemID, itemID, since.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
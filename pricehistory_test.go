@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
+)
+
+func TestSnapshotPrices(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	if err := updateTradeableItemsCache(db, []int{10, 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := fakeapi.New()
+	err := fake.AddPrices(
+		ItemPrice{ID: 10, Buys: TradingPostPrice{UnitPrice: 100, Quantity: 5}, Sells: TradingPostPrice{UnitPrice: 120, Quantity: 7}},
+		ItemPrice{ID: 20, Buys: TradingPostPrice{UnitPrice: 200}, Sells: TradingPostPrice{UnitPrice: 250}},
+	)
+	if err != nil {
+		t.Fatalf("Failed to seed prices: %v", err)
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	client := NewAPIClient(server.URL, "token")
+
+	first := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	// Item 30 is not tradeable, so it is skipped instead of failing the batch
+	recorded, err := SnapshotPrices(client, db, []int{10, 20, 30}, first)
+	if err != nil || recorded != 2 {
+		t.Fatalf("SnapshotPrices() = %d, %v, want 2 recorded", recorded, err)
+	}
+	if err := fake.AddPrices(ItemPrice{ID: 10, Buys: TradingPostPrice{UnitPrice: 140}, Sells: TradingPostPrice{UnitPrice: 160}}); err != nil {
+		t.Fatal(err)
+	}
+	second := first.Add(time.Hour)
+	if _, err := SnapshotPrices(client, db, []int{10}, second); err != nil {
+		t.Fatalf("Second SnapshotPrices() returned error: %v", err)
+	}
+
+	lc := NewLocalCache(db)
+	history, err := lc.GetPriceHistory(10, first, second.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("GetPriceHistory() returned error: %v", err)
+	}
+	want := []PriceSnapshot{
+		{ItemID: 10, RecordedAt: first, BuyPrice: 100, BuyQuantity: 5, SellPrice: 120, SellQuantity: 7},
+		{ItemID: 10, RecordedAt: second, BuyPrice: 140, SellPrice: 160},
+	}
+	if !reflect.DeepEqual(history, want) {
+		t.Errorf("GetPriceHistory() = %+v, want %+v", history, want)
+	}
+
+	latest, err := lc.GetLatestPrice(10)
+	if err != nil || latest == nil || latest.BuyPrice != 140 {
+		t.Errorf("GetLatestPrice() = %+v, %v, want buy price 140", latest, err)
+	}
+	if latest, err := lc.GetLatestPrice(30); err != nil || latest != nil {
+		t.Errorf("GetLatestPrice() of an unrecorded item = %+v, %v, want nil", latest, err)
+	}
+
+	tests := []struct {
+		name  string
+		since time.Time
+		want  PriceStats
+	}{
+		{"Both snapshots", first, PriceStats{ItemID: 10, Snapshots: 2, MinBuy: 100, MaxBuy: 140, AverageBuy: 120, MinSell: 120, MaxSell: 160, AverageSell: 140}},
+		{"Latest snapshot only", second, PriceStats{ItemID: 10, Snapshots: 1, MinBuy: 140, MaxBuy: 140, AverageBuy: 140, MinSell: 160, MaxSell: 160, AverageSell: 160}},
+		{"No snapshots", second.Add(time.Minute), PriceStats{ItemID: 10}},
+	}
+	for _, tt := range tests {
+		stats, err := lc.GetPriceStats(10, tt.since, second.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("%s: GetPriceStats() returned error: %v", tt.name, err)
+		}
+		if *stats != tt.want {
+			t.Errorf("%s: GetPriceStats() = %+v, want %+v", tt.name, *stats, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultPriceTTL is how long a fetched price is reused within a run. Trading
+// Post prices move slowly enough that a scan can share them safely.
+const defaultPriceTTL = 2 * time.Minute
+
+// A priceStore caches item prices for a short time and coalesces concurrent
+// lookups of the same item into a single fetch
+type priceStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int]*priceEntry
+	now     func() time.Time // replaced in tests
+}
+
+// A priceEntry is an in-flight or completed fetch; done is closed once
+// price and err are set
+type priceEntry struct {
+	done      chan struct{}
+	price     *ItemPrice
+	err       error
+	fetchedAt time.Time
+}
+
+func newPriceStore(ttl time.Duration) *priceStore {
+	return &priceStore{ttl: ttl, entries: make(map[int]*priceEntry), now: time.Now}
+}
+
+// get returns the stored price of itemID, calling fetch when there is no fresh
+// one. Callers arriving while a fetch is in flight wait for its result.
+// Failed fetches are shared with the waiting callers but not stored.
+func (store *priceStore) get(itemID int, fetch func(int) (*ItemPrice, error)) (*ItemPrice, error) {
+	store.mu.Lock()
+	if entry, ok := store.entries[itemID]; ok {
+		select {
+		case <-entry.done:
+			if store.now().Sub(entry.fetchedAt) < store.ttl {
+				store.mu.Unlock()
+				return entry.price, nil
+			}
+			// Expired, fall through and fetch again
+		default:
+			store.mu.Unlock()
+			<-entry.done
+			return entry.price, entry.err
+		}
+	}
+	entry := &priceEntry{done: make(chan struct{})}
+	store.entries[itemID] = entry
+	store.mu.Unlock()
+
+	entry.price, entry.err = fetch(itemID)
+	entry.fetchedAt = store.now()
+
+	store.mu.Lock()
+	if entry.err != nil && store.entries[itemID] == entry {
+		delete(store.entries, itemID)
+	}
+	store.mu.Unlock()
+	close(entry.done)
+	return entry.price, entry.err
+}
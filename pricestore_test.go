@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPriceStoreCoalescesConcurrentFetches(t *testing.T) {
+	store := newPriceStore(time.Minute)
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func(itemID int) (*ItemPrice, error) {
+		fetches.Add(1)
+		<-release
+		return &ItemPrice{ID: itemID, Buys: TradingPostPrice{UnitPrice: 100}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			price, err := store.get(10, fetch)
+			if err != nil || price.Buys.UnitPrice != 100 {
+				t.Errorf("get() = %+v, %v, want price 100", price, err)
+			}
+		}()
+	}
+	// Let every goroutine reach the store before the fetch completes
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("fetch called %d times, want 1", got)
+	}
+}
+
+func TestPriceStoreExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newPriceStore(time.Minute)
+	store.now = func() time.Time { return now }
+	fetches := 0
+	failNext := false
+	fetch := func(itemID int) (*ItemPrice, error) {
+		fetches++
+		if failNext {
+			return nil, errors.New("boom")
+		}
+		return &ItemPrice{ID: itemID}, nil
+	}
+
+	tests := []struct {
+		name        string
+		advance     time.Duration
+		fail        bool
+		wantErr     bool
+		wantFetches int
+	}{
+		{name: "first lookup fetches", wantFetches: 1},
+		{name: "fresh price is reused", advance: 30 * time.Second, wantFetches: 1},
+		{name: "expired price is fetched again", advance: time.Minute, wantFetches: 2},
+		{name: "failed fetch is returned", advance: 2 * time.Minute, fail: true, wantErr: true, wantFetches: 3},
+		{name: "failed fetch is not stored", fail: true, wantErr: true, wantFetches: 4},
+		{name: "recovers after failure", wantFetches: 5},
+	}
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		failNext = tt.fail
+		_, err := store.get(10, fetch)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: get() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if fetches != tt.wantFetches {
+			t.Errorf("%s: fetch called %d times, want %d", tt.name, fetches, tt.wantFetches)
+		}
+	}
+}
+
+func TestCraftersSharePrices(t *testing.T) {
+	var priceRequests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/commerce/prices/10" {
+			priceRequests.Add(1)
+		}
+		w.Write([]byte(`{"id": 10, "buys": {"unit_price": 100}, "sells": {"unit_price": 120}}`))
+	}))
+	defer server.Close()
+
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	localCache := NewLocalCache(db)
+	// Each account has its own client, but prices are the same for all of them
+	crafters := []*Crafter{
+		NewCrafter(*NewAPIClient(server.URL, "first"), *localCache),
+		NewCrafter(*NewAPIClient(server.URL, "second"), *localCache),
+	}
+	for i, crafter := range crafters {
+		price, err := crafter.fetchItemTPPrice(10)
+		if err != nil || price.Buys.UnitPrice != 100 {
+			t.Errorf("Crafter %d fetchItemTPPrice() = %+v, %v, want buy price 100", i, price, err)
+		}
+	}
+	if got := priceRequests.Load(); got != 1 {
+		t.Errorf("Prices were requested %d times, want 1", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A tradeTotal accumulates the quantity and total value of fulfilled orders for an item
+type tradeTotal struct {
+	quantity int
+	value    int
+}
+
+func (total tradeTotal) averageUnitPrice() int {
+	if total.quantity == 0 {
+		return 0
+	}
+	return total.value / total.quantity
+}
+
+func aggregateTransactions(transactions []Transaction) map[int]tradeTotal {
+	totals := make(map[int]tradeTotal)
+	for _, transaction := range transactions {
+		total := totals[transaction.ItemID]
+		total.quantity += transaction.Quantity
+		total.value += transaction.Price * transaction.Quantity
+		totals[transaction.ItemID] = total
+	}
+	return totals
+}
+
+// purchasedRecipeCost calculates the cost of crafting a recipe once using the average
+// price paid for each ingredient. Returns false if any ingredient was not bought.
+func purchasedRecipeCost(recipe Recipe, purchases map[int]tradeTotal) (int, bool) {
+	recipeCost := 0
+	for _, ingredient := range recipe.Ingredients {
+		purchase, ok := purchases[ingredient.ItemID]
+		if !ok {
+			return 0, false
+		}
+		recipeCost += purchase.averageUnitPrice() * ingredient.Count
+	}
+	return recipeCost, true
+}
+
+// RealizedProfits matches the crafted items sold on the Trading Post between since
+// and until against the ingredients bought before until, using the local
+// transaction history. Ingredients are usually bought well before the crafts are
+// sold, so every synced purchase counts, not only those in the window. When
+// several recipes produce a sold item, the cheapest one whose ingredients were
+// all bought is assumed.
+func (crafter *Crafter) RealizedProfits(since, until time.Time) ([]RealizedProfit, error) {
+	sells, err := crafter.localCache.GetTransactions(TransactionSideSells, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load sell transactions: %w", err)
+	}
+	buys, err := crafter.localCache.GetTransactions(TransactionSideBuys, time.Time{}, until)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load buy transactions: %w", err)
+	}
+	purchases := aggregateTransactions(buys)
+
+	var realizedProfits []RealizedProfit
+	for itemID, sale := range aggregateTransactions(sells) {
+		recipes, err := crafter.localCache.GetRecipesByOutput(itemID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to fetch recipes for itemID %d: %w", itemID, err)
+		}
+
+		var bestRecipe *Recipe
+		bestCost := 0
+		for i, recipe := range recipes {
+			recipeCost, ok := purchasedRecipeCost(recipe, purchases)
+			if !ok || recipe.OutputItemCount == 0 {
+				continue
+			}
+			if bestRecipe == nil || recipeCost < bestCost {
+				bestRecipe = &recipes[i]
+				bestCost = recipeCost
+			}
+		}
+		if bestRecipe == nil {
+			logger.Debug("No crafted source found for sold item", "itemID", itemID)
+			continue
+		}
+
+		revenue := int(float64(sale.value) * tradingPostFeeMultiplier)
+		ingredientCost := bestCost * sale.quantity / bestRecipe.OutputItemCount
+		realizedProfit := RealizedProfit{
+			RecipeID:       bestRecipe.ID,
+			OutputItemID:   itemID,
+			UnitsSold:      sale.quantity,
+			Revenue:        revenue,
+			IngredientCost: ingredientCost,
+			Profit:         revenue - ingredientCost,
+		}
+		if ingredientCost > 0 {
+			realizedProfit.ProfitMargin = float64(revenue) / float64(ingredientCost)
+		}
+		realizedProfits = append(realizedProfits, realizedProfit)
+	}
+
+	sort.Slice(realizedProfits, func(i, j int) bool {
+		if realizedProfits[i].Profit != realizedProfits[j].Profit {
+			return realizedProfits[i].Profit > realizedProfits[j].Profit
+		}
+		return realizedProfits[i].RecipeID < realizedProfits[j].RecipeID
+	})
+
+	return realizedProfits, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRealizedProfits(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	db.SetMaxOpenConns(1)
+
+	recipes := []Recipe{
+		{ID: 1, Type: "Refinement", OutputItemID: 100, OutputItemCount: 2, Ingredients: []Ingredient{{ItemID: 10, Count: 3}, {ItemID: 11, Count: 1}}},
+		{ID: 2, Type: "Refinement", OutputItemID: 200, OutputItemCount: 1, Ingredients: []Ingredient{{ItemID: 12, Count: 1}}},
+		{ID: 3, Type: "Refinement", OutputItemID: 300, OutputItemCount: 1, Ingredients: []Ingredient{{ItemID: 13, Count: 1}}},
+	}
+	if err := updateRecipeCache(db, recipes); err != nil {
+		t.Fatalf("Failed to update recipe cache: %v", err)
+	}
+
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	buys := []Transaction{
+		{ID: 1, ItemID: 10, Price: 10, Quantity: 3, Purchased: now.Add(-time.Hour)},
+		{ID: 2, ItemID: 10, Price: 20, Quantity: 3, Purchased: now.Add(-2 * time.Hour)},
+		{ID: 3, ItemID: 11, Price: 50, Quantity: 1, Purchased: now.Add(-time.Hour)},
+		{ID: 4, ItemID: 12, Price: 500, Quantity: 1, Purchased: now.Add(-48 * time.Hour)}, // bought before the window
+		{ID: 7, ItemID: 12, Price: 100, Quantity: 1, Purchased: now.Add(time.Hour)},       // bought after the window
+		{ID: 8, ItemID: 13, Price: 190, Quantity: 1, Purchased: now.Add(-time.Hour)},
+	}
+	sells := []Transaction{
+		{ID: 5, ItemID: 100, Price: 100, Quantity: 4, Purchased: now.Add(-30 * time.Minute)},
+		{ID: 6, ItemID: 200, Price: 1000, Quantity: 1, Purchased: now.Add(-30 * time.Minute)},
+		{ID: 9, ItemID: 300, Price: 400, Quantity: 1, Purchased: now.Add(-30 * time.Minute)},
+	}
+	if err := updateTransactionCache(db, TransactionSideBuys, buys); err != nil {
+		t.Fatalf("Failed to update buy transactions: %v", err)
+	}
+	if err := updateTransactionCache(db, TransactionSideSells, sells); err != nil {
+		t.Fatalf("Failed to update sell transactions: %v", err)
+	}
+
+	crafter := NewCrafter(*NewAPIClient("localhost", "token"), *NewLocalCache(db))
+	realizedProfits, err := crafter.RealizedProfits(now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatalf("RealizedProfits() returned error: %v", err)
+	}
+
+	// Item 200's ingredient was bought before the window, but still counts. Recipes 1
+	// and 3 tie on profit and are ordered by ID.
+	want := []RealizedProfit{
+		// 1 unit sold at 1000 with fees = 850; 1 craft at 500
+		{RecipeID: 2, OutputItemID: 200, UnitsSold: 1, Revenue: 850, IngredientCost: 500, Profit: 350, ProfitMargin: 850.0 / 500.0},
+		// 4 units sold at 100 with fees = 340; 2 crafts at (3*15 + 50) = 190
+		{RecipeID: 1, OutputItemID: 100, UnitsSold: 4, Revenue: 340, IngredientCost: 190, Profit: 150, ProfitMargin: 340.0 / 190.0},
+		{RecipeID: 3, OutputItemID: 300, UnitsSold: 1, Revenue: 340, IngredientCost: 190, Profit: 150, ProfitMargin: 340.0 / 190.0},
+	}
+	if !reflect.DeepEqual(realizedProfits, want) {
+		t.Errorf("RealizedProfits() = %+v, want %+v", realizedProfits, want)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// A RecipeGraph links every cached recipe to the items it produces and
+// consumes, so deep recipe searches never have to go back to SQLite
+type RecipeGraph struct {
+	recipes         map[int]*Recipe
+	byOutput        map[int][]*Recipe // item -> recipes producing it
+	byIngredient    map[int][]*Recipe // item -> recipes consuming it
+	byOutputUpgrade map[int][]*Recipe // guild upgrade -> recipes producing it
+}
+
+// NewRecipeGraph indexes the given recipes, each lookup returning recipes in ID order
+func NewRecipeGraph(recipes []Recipe) *RecipeGraph {
+	graph := &RecipeGraph{
+		recipes:         make(map[int]*Recipe, len(recipes)),
+		byOutput:        make(map[int][]*Recipe),
+		byIngredient:    make(map[int][]*Recipe),
+		byOutputUpgrade: make(map[int][]*Recipe),
+	}
+	sorted := make([]Recipe, len(recipes))
+	copy(sorted, recipes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	for i := range sorted {
+		recipe := &sorted[i]
+		graph.recipes[recipe.ID] = recipe
+		if recipe.OutputItemID != 0 {
+			graph.byOutput[recipe.OutputItemID] = append(graph.byOutput[recipe.OutputItemID], recipe)
+		}
+		if recipe.OutputUpgradeID != 0 {
+			graph.byOutputUpgrade[recipe.OutputUpgradeID] = append(graph.byOutputUpgrade[recipe.OutputUpgradeID], recipe)
+		}
+		for _, ingredient := range recipe.Ingredients {
+			graph.byIngredient[ingredient.ItemID] = append(graph.byIngredient[ingredient.ItemID], recipe)
+		}
+	}
+	return graph
+}
+
+// Len returns the number of recipes in the graph
+func (graph *RecipeGraph) Len() int {
+	return len(graph.recipes)
+}
+
+// Recipe returns the recipe with the given ID, nil when it is not cached
+func (graph *RecipeGraph) Recipe(recipeID int) *Recipe {
+	recipe, ok := graph.recipes[recipeID]
+	if !ok {
+		return nil
+	}
+	copied := cloneRecipe(recipe)
+	return &copied
+}
+
+// RecipesProducing returns the recipes whose output is the given item
+func (graph *RecipeGraph) RecipesProducing(itemID int) []Recipe {
+	return copyRecipes(graph.byOutput[itemID])
+}
+
+// RecipesConsuming returns the recipes using the given item as an ingredient
+func (graph *RecipeGraph) RecipesConsuming(itemID int) []Recipe {
+	return copyRecipes(graph.byIngredient[itemID])
+}
+
+// RecipeProducingUpgrade returns the first recipe producing a guild upgrade,
+// nil when there is none
+func (graph *RecipeGraph) RecipeProducingUpgrade(upgradeID int) *Recipe {
+	recipes := graph.byOutputUpgrade[upgradeID]
+	if len(recipes) == 0 {
+		return nil
+	}
+	copied := cloneRecipe(recipes[0])
+	return &copied
+}
+
+func copyRecipes(recipes []*Recipe) []Recipe {
+	var copied []Recipe
+	for _, recipe := range recipes {
+		copied = append(copied, cloneRecipe(recipe))
+	}
+	return copied
+}
+
+// cloneRecipe copies a recipe together with its slices, so callers modifying
+// the result cannot change the graph shared by every crafter
+func cloneRecipe(recipe *Recipe) Recipe {
+	copied := *recipe
+	copied.Disciplines = slices.Clone(recipe.Disciplines)
+	copied.Flags = slices.Clone(recipe.Flags)
+	copied.Ingredients = slices.Clone(recipe.Ingredients)
+	copied.GuildIngredients = slices.Clone(recipe.GuildIngredients)
+	return copied
+}
+
+// LoadRecipeGraph loads every cached recipe into memory. Afterwards the recipe
+// lookups of this cache, and of every crafter sharing it, are served from the
+// graph instead of SQLite, so it has to be loaded after the cache is refreshed.
+func (lc *LocalCache) LoadRecipeGraph() error {
+	recipes, err := loadRecipeCache(lc.db)
+	if err != nil {
+		return fmt.Errorf("Failed to load recipe graph: %w", err)
+	}
+	lc.recipes = NewRecipeGraph(recipes)
+	logger.Debug("Loaded recipe graph", "recipes", lc.recipes.Len())
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRecipeGraphLookups(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	recipes := []Recipe{
+		{ID: 3, Type: "Component", OutputItemID: 300, OutputItemCount: 1, Disciplines: StringSlice{"Armorsmith"}, Flags: StringSlice{"AutoLearned"},
+			Ingredients: []Ingredient{{ItemID: 100, Count: 2}, {ItemID: 10, Count: 1}}},
+		{ID: 1, Type: "Refinement", OutputItemID: 100, OutputItemCount: 1, Disciplines: StringSlice{"Armorsmith", "Weaponsmith"}, Flags: StringSlice{"AutoLearned"},
+			Ingredients: []Ingredient{{ItemID: 10, Count: 2}}},
+		{ID: 2, Type: "Refinement", OutputItemID: 100, OutputItemCount: 2, Disciplines: StringSlice{"Huntsman"}, Flags: StringSlice{""},
+			Ingredients: []Ingredient{{ItemID: 20, Count: 5}}},
+		{ID: 4, Type: "Refinement", OutputUpgradeID: 500, OutputItemCount: 1, Disciplines: StringSlice{"Scribe"}, Flags: StringSlice{""},
+			Ingredients: []Ingredient{{ItemID: 10, Count: 1}}, GuildIngredients: []GuildIngredient{{UpgradeID: 600, Count: 1}}},
+	}
+	if err := updateRecipeCache(db, recipes); err != nil {
+		t.Fatalf("Failed to update recipe cache: %v", err)
+	}
+
+	// The graph does not fill in missing guild ingredients as empty slices
+	normalize := func(recipes ...Recipe) []Recipe {
+		for i := range recipes {
+			if len(recipes[i].GuildIngredients) == 0 {
+				recipes[i].GuildIngredients = nil
+			}
+		}
+		return recipes
+	}
+	type lookups struct {
+		Consuming, Unused, Producing []Recipe
+		ByID                         Recipe
+		ByUpgrade                    Recipe
+		MissingUpgrade               *Recipe
+	}
+	lookup := func(t *testing.T, lc *LocalCache) lookups {
+		t.Helper()
+		var results lookups
+		var err error
+		if results.Consuming, err = lc.GetRecipeByIngredient(10); err != nil {
+			t.Fatal(err)
+		}
+		if results.Unused, err = lc.GetRecipeByIngredient(999); err != nil {
+			t.Fatal(err)
+		}
+		if results.Producing, err = lc.GetRecipesByOutput(100); err != nil {
+			t.Fatal(err)
+		}
+		recipe, err := lc.GetRecipeById(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results.ByID = *recipe
+		if _, err := lc.GetRecipeById(999); err == nil {
+			t.Error("GetRecipeById(999) returned no error for a missing recipe")
+		}
+		upgradeRecipe, err := lc.GetRecipeByOutputUpgrade(500)
+		if err != nil || upgradeRecipe == nil {
+			t.Fatalf("GetRecipeByOutputUpgrade(500) = %v, %v, want recipe 4", upgradeRecipe, err)
+		}
+		results.ByUpgrade = *upgradeRecipe
+		if results.MissingUpgrade, err = lc.GetRecipeByOutputUpgrade(600); err != nil {
+			t.Fatal(err)
+		}
+		results.Consuming = normalize(results.Consuming...)
+		results.Producing = normalize(results.Producing...)
+		results.ByID = normalize(results.ByID)[0]
+		return results
+	}
+	recipeIDs := func(recipes []Recipe) []int {
+		var ids []int
+		for _, recipe := range recipes {
+			ids = append(ids, recipe.ID)
+		}
+		return ids
+	}
+
+	fromSQL := lookup(t, NewLocalCache(db))
+	if got := recipeIDs(fromSQL.Consuming); !reflect.DeepEqual(got, []int{1, 3, 4}) {
+		t.Errorf("GetRecipeByIngredient(10) = %v, want recipes [1 3 4]", got)
+	}
+	if got := recipeIDs(fromSQL.Producing); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("GetRecipesByOutput(100) = %v, want recipes [1 2]", got)
+	}
+	if fromSQL.ByUpgrade.ID != 4 || len(fromSQL.ByUpgrade.GuildIngredients) != 1 || fromSQL.MissingUpgrade != nil {
+		t.Errorf("GetRecipeByOutputUpgrade() = %+v and %+v, want recipe 4 and nil", fromSQL.ByUpgrade, fromSQL.MissingUpgrade)
+	}
+
+	lc := NewLocalCache(db)
+	if err := lc.LoadRecipeGraph(); err != nil {
+		t.Fatalf("LoadRecipeGraph() returned error: %v", err)
+	}
+	if lc.recipes.Len() != len(recipes) {
+		t.Errorf("Recipe graph has %d recipes, want %d", lc.recipes.Len(), len(recipes))
+	}
+	// Lookups must not touch the database once the graph is loaded
+	if _, err := db.Exec("DELETE FROM ingredients; DELETE FROM guild_ingredients; DELETE FROM recipes"); err != nil {
+		t.Fatal(err)
+	}
+	fromGraph := lookup(t, lc)
+	// The SQL lookups by ingredient and output skip guild ingredients
+	fromGraph.Consuming[2].GuildIngredients = nil
+	if !reflect.DeepEqual(fromGraph, fromSQL) {
+		t.Errorf("Recipe graph lookups = %+v, want the SQLite results %+v", fromGraph, fromSQL)
+	}
+}
+
+func TestRecipeGraphReturnsCopies(t *testing.T) {
+	graph := NewRecipeGraph([]Recipe{
+		{ID: 1, OutputItemID: 100, Disciplines: StringSlice{"Armorsmith"}, Flags: StringSlice{"AutoLearned"},
+			Ingredients: []Ingredient{{ItemID: 10, Count: 2}, {ItemID: 20, Count: 1}}},
+	})
+
+	recipe := graph.Recipe(1)
+	recipe.Ingredients[0].Count = 99
+	recipe.Disciplines[0] = "Scribe"
+	produced := graph.RecipesProducing(100)
+	sort.Slice(produced[0].Ingredients, func(i, j int) bool {
+		return produced[0].Ingredients[i].ItemID > produced[0].Ingredients[j].ItemID
+	})
+
+	want := []Ingredient{{ItemID: 10, Count: 2}, {ItemID: 20, Count: 1}}
+	if got := graph.RecipesConsuming(10)[0]; !reflect.DeepEqual(got.Ingredients, want) || got.Disciplines[0] != "Armorsmith" {
+		t.Errorf("Graph recipe after modifying returned copies = %+v, want it unchanged", got)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// A fixture is a single recorded request/response pair. Request headers are
+// not stored so fixtures never contain API keys and can be shared.
+type fixture struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+var unsafeFixtureChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// fixtureName builds a readable, unique file name for the nth occurrence of a request.
+// Repeated requests are numbered so replay serves responses in the recorded order.
+func fixtureName(method, url string, occurrence int) string {
+	hash := sha256.Sum256([]byte(method + " " + url))
+	readable := unsafeFixtureChars.ReplaceAllString(method+"_"+url, "_")
+	if len(readable) > 80 {
+		readable = readable[:80]
+	}
+	return fmt.Sprintf("%s-%s-%03d.json", readable, hex.EncodeToString(hash[:4]), occurrence)
+}
+
+// fixtureCounter tracks how many times each request has been seen in this run
+type fixtureCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (fc *fixtureCounter) next(key string) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.counts == nil {
+		fc.counts = make(map[string]int)
+	}
+	occurrence := fc.counts[key]
+	fc.counts[key]++
+	return occurrence
+}
+
+// A recordingTransport forwards requests and saves every response to a fixture directory
+type recordingTransport struct {
+	dir     string
+	next    http.RoundTripper
+	counter fixtureCounter
+}
+
+// NewRecordingTransport records every response passing through next (or the
+// default transport when nil) into dir, for later use with NewReplayTransport
+func NewRecordingTransport(dir string, next http.RoundTripper) (http.RoundTripper, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &recordingTransport{dir: dir, next: next}, nil
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	response, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	url := req.URL.String()
+	recorded := fixture{
+		Method:     req.Method,
+		URL:        url,
+		StatusCode: response.StatusCode,
+		Header:     response.Header,
+		Body:       string(body),
+	}
+	data, err := json.MarshalIndent(recorded, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	name := fixtureName(req.Method, url, rt.counter.next(req.Method+" "+url))
+	if err := os.WriteFile(filepath.Join(rt.dir, name), data, 0o644); err != nil {
+		return nil, fmt.Errorf("Failed to record fixture for %s: %w", url, err)
+	}
+	logger.Debug("Recorded response", "url", url, "fixture", name)
+	return response, nil
+}
+
+// A replayTransport serves responses from a fixture directory without network access.
+// Once a request's recorded occurrences run out, its last recorded response is reused.
+type replayTransport struct {
+	dir     string
+	counter fixtureCounter
+}
+
+// NewReplayTransport serves responses previously saved by NewRecordingTransport
+func NewReplayTransport(dir string) (http.RoundTripper, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Replay fixture path %s is not a directory", dir)
+	}
+	return &replayTransport{dir: dir}, nil
+}
+
+func (rt *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	url := req.URL.String()
+	occurrence := rt.counter.next(req.Method + " " + url)
+	for ; occurrence >= 0; occurrence-- {
+		data, err := os.ReadFile(filepath.Join(rt.dir, fixtureName(req.Method, url, occurrence)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var recorded fixture
+		if err := json.Unmarshal(data, &recorded); err != nil {
+			return nil, fmt.Errorf("Failed to parse fixture for %s: %w", url, err)
+		}
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+			StatusCode: recorded.StatusCode,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     recorded.Header,
+			Body:       io.NopCloser(bytes.NewReader([]byte(recorded.Body))),
+			Request:    req,
+		}, nil
+	}
+	return nil, fmt.Errorf("No recorded response for %s %s", req.Method, url)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/commerce/prices/2" {
+			http.NotFound(w, r)
+			return
+		}
+		// Each response differs so replay order can be verified
+		fmt.Fprintf(w, `{"id": 1, "buys": {"quantity": 1, "unit_price": %d}, "sells": {"quantity": 1, "unit_price": 0}}`, requests)
+	}))
+	fixtureDir := t.TempDir()
+
+	recorder, err := NewRecordingTransport(fixtureDir, nil)
+	if err != nil {
+		t.Fatalf("NewRecordingTransport() returned error: %v", err)
+	}
+	recordingClient := NewAPIClient(server.URL, "secret-token", WithTransport(recorder))
+	var recorded []int
+	for i := 0; i < 2; i++ {
+		itemPrice, err := recordingClient.FetchItemPrice(1)
+		if err != nil {
+			t.Fatalf("FetchItemPrice() returned error while recording: %v", err)
+		}
+		recorded = append(recorded, itemPrice.Buys.UnitPrice)
+	}
+	_, recordedErr := recordingClient.FetchItemPrice(2)
+	server.Close()
+
+	replayer, err := NewReplayTransport(fixtureDir)
+	if err != nil {
+		t.Fatalf("NewReplayTransport() returned error: %v", err)
+	}
+	replayClient := NewAPIClient(server.URL, "secret-token", WithTransport(replayer))
+	for i, want := range []int{recorded[0], recorded[1], recorded[1]} {
+		itemPrice, err := replayClient.FetchItemPrice(1)
+		if err != nil {
+			t.Fatalf("FetchItemPrice() returned error while replaying: %v", err)
+		}
+		if itemPrice.Buys.UnitPrice != want {
+			t.Errorf("Replayed request %d returned buy price %d, want %d", i, itemPrice.Buys.UnitPrice, want)
+		}
+	}
+
+	_, err = replayClient.FetchItemPrice(2)
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.StatusCode != http.StatusNotFound || recordedErr == nil {
+		t.Errorf("Replayed error = %v, want recorded 404 %v", err, recordedErr)
+	}
+
+	_, err = replayClient.FetchItemPrice(3)
+	if err == nil || !strings.Contains(err.Error(), "No recorded response") {
+		t.Errorf("FetchItemPrice() for unrecorded request returned %v, want missing fixture error", err)
+	}
+}
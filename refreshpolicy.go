@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A cacheDataset is a group of cache tables that are fetched and replaced
+// together. Every dataset is refreshed on a new build, and in between once
+// its TTL has passed. Recipes and items are an exception: their TTL only
+// picks up new IDs, and known entries are refetched by full refreshes or
+// when the dataset is forced.
+type cacheDataset struct {
+	name    string
+	tables  []string
+	ttl     time.Duration
+	inPlace bool // updated in place by its importer, so the staging cache always starts from a copy
+}
+
+var cacheDatasets = []cacheDataset{
+	{"recipes", []string{"recipes", "ingredients", "guild_ingredients"}, 24 * time.Hour, false},
+	{"items", []string{"items"}, 24 * time.Hour, false},
+	{"tradeable", []string{"tradeable_items"}, 6 * time.Hour, false},
+	{"currencies", []string{"currencies"}, 7 * 24 * time.Hour, false},
+	{"guild_upgrades", []string{"guild_upgrades", "guild_upgrade_costs"}, 7 * 24 * time.Hour, false},
+	{"material_categories", []string{"material_categories", "material_category_items"}, 7 * 24 * time.Hour, false},
+	{"daily_crafting", []string{"daily_crafting"}, 24 * time.Hour, false},
+	{"merchants", []string{"merchants", "purchase_options", "merchant_prices"}, 24 * time.Hour, true},
+}
+
+// CacheDatasetNames lists the datasets that can be forced to refresh
+func CacheDatasetNames() []string {
+	names := make([]string, len(cacheDatasets))
+	for i, dataset := range cacheDatasets {
+		names[i] = dataset.name
+	}
+	return names
+}
+
+// A cacheRefreshPlan lists the datasets a refresh rebuilds
+type cacheRefreshPlan struct {
+	datasets map[string]bool
+	newBuild bool
+	full     bool            // refetch every recipe and item instead of only new ones
+	refetch  map[string]bool // recipes and items refetched including their known IDs
+}
+
+// storeDatasetTTLs records the TTL of every dataset, applying the overrides on
+// top of the defaults
+func storeDatasetTTLs(db *sqlx.DB, overrides map[string]time.Duration) error {
+	for name := range overrides {
+		if !slices.Contains(CacheDatasetNames(), name) {
+			return fmt.Errorf("Unknown cache dataset %q", name)
+		}
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, dataset := range cacheDatasets {
+		ttl := dataset.ttl
+		if override, ok := overrides[dataset.name]; ok {
+			ttl = override
+		}
+		_, err = tx.Exec(`
+			INSERT INTO dataset_metadata (dataset, ttl_seconds) VALUES (?, ?)
+			ON CONFLICT (dataset) DO UPDATE SET ttl_seconds = excluded.ttl_seconds
+		`, dataset.name, int64(ttl.Seconds()))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to store TTL of %s: %w", dataset.name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// planCacheRefresh decides which datasets are due: all of them on a new build,
+// otherwise the forced ones, the expired ones and merchants when the merchant
+// data file changed since they were loaded
+func planCacheRefresh(db *sqlx.DB, buildNumber int, merchantDataPath string, options CacheRefreshOptions, now time.Time) (cacheRefreshPlan, error) {
+	for _, name := range options.ForceDatasets {
+		if !slices.Contains(CacheDatasetNames(), name) {
+			return cacheRefreshPlan{}, fmt.Errorf("Unknown cache dataset %q, expected one of %v", name, CacheDatasetNames())
+		}
+	}
+	storedBuildNumber, err := fetchStoredBuildNumber(db)
+	if err != nil {
+		return cacheRefreshPlan{}, fmt.Errorf("Cannot fetch stored build number from local cache: %w", err)
+	}
+	var policies []struct {
+		Dataset       string       `db:"dataset"`
+		LastRefreshed sql.NullTime `db:"last_refreshed"`
+		TTLSeconds    int64        `db:"ttl_seconds"`
+	}
+	err = db.Select(&policies, "SELECT dataset, last_refreshed, ttl_seconds FROM dataset_metadata")
+	if err != nil {
+		return cacheRefreshPlan{}, fmt.Errorf("Failed to load dataset refresh policies: %w", err)
+	}
+
+	plan := cacheRefreshPlan{datasets: make(map[string]bool), refetch: make(map[string]bool), newBuild: buildNumber > storedBuildNumber}
+	if plan.newBuild {
+		logger.Info("Found new build, updating local cache...", "buildNumber", buildNumber)
+		for _, dataset := range cacheDatasets {
+			plan.datasets[dataset.name] = true
+		}
+	}
+	for _, name := range options.ForceDatasets {
+		plan.datasets[name] = true
+		plan.refetch[name] = name == "recipes" || name == "items"
+	}
+	for _, policy := range policies {
+		if plan.datasets[policy.Dataset] {
+			continue
+		}
+		ttl := time.Duration(policy.TTLSeconds) * time.Second
+		switch {
+		case !policy.LastRefreshed.Valid:
+			plan.datasets[policy.Dataset] = true
+		case now.Sub(policy.LastRefreshed.Time) >= ttl:
+			logger.Info("Cache dataset expired", "dataset", policy.Dataset, "lastRefreshed", policy.LastRefreshed.Time, "ttl", ttl.String())
+			plan.datasets[policy.Dataset] = true
+		case policy.Dataset == "merchants":
+			info, err := os.Stat(merchantDataPath)
+			if err == nil && info.ModTime().After(policy.LastRefreshed.Time) {
+				logger.Info("Merchant data changed since it was loaded", "path", merchantDataPath)
+				plan.datasets[policy.Dataset] = true
+			}
+		}
+	}
+
+	plan.full, err = needsFullRefresh(db, options, now)
+	if err != nil {
+		return cacheRefreshPlan{}, err
+	}
+	// A full refresh always covers both, so it is never recorded for half of them
+	if plan.full {
+		for _, name := range []string{"recipes", "items"} {
+			plan.datasets[name] = true
+			plan.refetch[name] = true
+		}
+	}
+	return plan, nil
+}
+
+// recordDatasetRefreshes stores when the refreshed datasets were rebuilt
+func recordDatasetRefreshes(tx *sqlx.Tx, plan cacheRefreshPlan, refreshedAt time.Time) error {
+	for name := range plan.datasets {
+		_, err := tx.Exec("UPDATE dataset_metadata SET last_refreshed = ? WHERE dataset = ?", refreshedAt, name)
+		if err != nil {
+			return fmt.Errorf("Could not record refresh of %s: %w", name, err)
+		}
+	}
+	return nil
+}
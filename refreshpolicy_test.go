@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
+)
+
+func TestPlanCacheRefresh(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := updateBuildMetadata(db, Metadata{BuildNumber: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeDatasetTTLs(db, map[string]time.Duration{"tradeable": time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE dataset_metadata SET last_refreshed = ?", now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE metadata SET last_full_refresh = ?", now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	merchantDataPath := filepath.Join(t.TempDir(), "merchant-data.json")
+	if err := os.WriteFile(merchantDataPath, []byte(`[]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		buildNumber   int
+		options       CacheRefreshOptions
+		merchantMtime time.Time
+		want          []string
+		wantFull      bool
+		wantErr       bool
+	}{
+		{name: "Only expired datasets", buildNumber: 100, want: []string{"tradeable"}},
+		{name: "Forced dataset", buildNumber: 100, options: CacheRefreshOptions{ForceDatasets: []string{"currencies"}}, want: []string{"tradeable", "currencies"}},
+		{name: "New build refreshes everything", buildNumber: 101, want: CacheDatasetNames()},
+		{name: "Changed merchant data", buildNumber: 100, merchantMtime: now.Add(-time.Hour), want: []string{"tradeable", "merchants"}},
+		{name: "Full refresh covers recipes and items", buildNumber: 100, options: CacheRefreshOptions{ForceFull: true}, want: []string{"recipes", "items", "tradeable"}, wantFull: true},
+		{name: "Unknown dataset", buildNumber: 100, options: CacheRefreshOptions{ForceDatasets: []string{"gems"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merchantMtime := tt.merchantMtime
+			if merchantMtime.IsZero() {
+				merchantMtime = now.Add(-3 * time.Hour)
+			}
+			if err := os.Chtimes(merchantDataPath, merchantMtime, merchantMtime); err != nil {
+				t.Fatal(err)
+			}
+			plan, err := planCacheRefresh(db, tt.buildNumber, merchantDataPath, tt.options, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("planCacheRefresh() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := plannedDatasetNames(plan); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planCacheRefresh() datasets = %v, want %v", got, tt.want)
+			}
+			if plan.full != tt.wantFull {
+				t.Errorf("planCacheRefresh() full = %v, want %v", plan.full, tt.wantFull)
+			}
+		})
+	}
+}
+
+func TestRefreshCacheDatasetWithinBuild(t *testing.T) {
+	fake := fakeapi.New()
+	if err := fake.AddItems(Item{ID: 10, Name: "Plank"}); err != nil {
+		t.Fatalf("Failed to seed items: %v", err)
+	}
+	if err := fake.AddPrices(ItemPrice{ID: 10}); err != nil {
+		t.Fatalf("Failed to seed prices: %v", err)
+	}
+	var itemRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/items" {
+			itemRequests++
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := NewAPIClient(server.URL, "token")
+
+	merchantDataPath := filepath.Join(t.TempDir(), "merchant-data.json")
+	if err := os.WriteFile(merchantDataPath, []byte(`[]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	if err := refreshCache(client, db, Metadata{BuildNumber: 100}, merchantDataPath, CacheRefreshOptions{}); err != nil {
+		t.Fatalf("refreshCache() returned error: %v", err)
+	}
+
+	// The refresh also reindexes the item names
+	if found, err := NewLocalCache(db).SearchItems(ItemSearch{Query: "plank"}); err != nil || len(found) != 1 {
+		t.Errorf("SearchItems() after refresh = %v, %v, want item 10", found, err)
+	}
+
+	// Nothing is due within the same build
+	itemRequests = 0
+	if err := refreshCache(client, db, Metadata{BuildNumber: 100}, merchantDataPath, CacheRefreshOptions{}); err != nil {
+		t.Fatalf("Second refreshCache() returned error: %v", err)
+	}
+	if itemRequests != 0 {
+		t.Errorf("Refresh without due datasets made %d item requests", itemRequests)
+	}
+
+	if err := fake.AddPrices(ItemPrice{ID: 20}); err != nil {
+		t.Fatal(err)
+	}
+	err := refreshCache(client, db, Metadata{BuildNumber: 100}, merchantDataPath, CacheRefreshOptions{ForceDatasets: []string{"tradeable"}})
+	if err != nil {
+		t.Fatalf("Forced refreshCache() returned error: %v", err)
+	}
+	if itemRequests != 0 {
+		t.Errorf("Refreshing tradeable items made %d item requests", itemRequests)
+	}
+	var tradeable []int
+	if err := db.Select(&tradeable, "SELECT id FROM tradeable_items ORDER BY id"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tradeable, []int{10, 20}) {
+		t.Errorf("Tradeable items = %v, want [10 20]", tradeable)
+	}
+	var items, knownItems int
+	if err := db.Get(&items, "SELECT COUNT(*) FROM items"); err != nil || items != 1 {
+		t.Errorf("Items after refreshing tradeable items = %d (%v), want 1", items, err)
+	}
+	if err := db.Get(&knownItems, "SELECT COUNT(*) FROM known_ids WHERE dataset = 'items'"); err != nil || knownItems != 1 {
+		t.Errorf("Known items after refreshing tradeable items = %d (%v), want 1", knownItems, err)
+	}
+	if buildNumber, _ := fetchStoredBuildNumber(db); buildNumber != 100 {
+		t.Errorf("Build number = %d, want 100", buildNumber)
+	}
+
+	// Forcing items refetches the known ones, picking up changed entries
+	if err := fake.AddItems(Item{ID: 10, Name: "Elder Wood Plank"}); err != nil {
+		t.Fatal(err)
+	}
+	err = refreshCache(client, db, Metadata{BuildNumber: 100}, merchantDataPath, CacheRefreshOptions{ForceDatasets: []string{"items"}})
+	if err != nil {
+		t.Fatalf("Forced items refreshCache() returned error: %v", err)
+	}
+	if itemRequests == 0 {
+		t.Errorf("Forcing items made no item requests")
+	}
+	item, err := NewLocalCache(db).GetItemById(10)
+	if err != nil || item.Name != "Elder Wood Plank" {
+		t.Errorf("Item 10 after forcing items = %+v (%v), want the renamed item", item, err)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// stagedTables are the tables rebuilt by a cache refresh. Account data such as
+// transactions is kept across refreshes and never staged.
+var stagedTables = []string{
+	"recipes",
+	"ingredients",
+	"guild_ingredients",
+	"items",
+	"tradeable_items",
+	"currencies",
+	"guild_upgrades",
+	"guild_upgrade_costs",
+	"material_categories",
+	"material_category_items",
+	"daily_crafting",
+	"merchants",
+	"purchase_options",
+	"merchant_prices",
+	"known_ids",
+	"deleted_ids",
+}
+
+// DefaultFullRefreshInterval is how often recipes and items are refetched in
+// full, since the API offers no way to detect changes to existing entries
+const DefaultFullRefreshInterval = 7 * 24 * time.Hour
+
+// CacheRefreshOptions control how UpdateCache refreshes the local cache
+type CacheRefreshOptions struct {
+	ForceFull           bool                     // refetch every recipe and item, even known ones
+	FullRefreshInterval time.Duration            // maximum time between full refreshes, DefaultFullRefreshInterval when 0
+	ForceDatasets       []string                 // datasets refreshed even if they have not expired
+	DatasetTTLs         map[string]time.Duration // overrides the default TTL of each dataset
+}
+
+// An idRefresh is the plan for one dataset of a refresh: the IDs the API
+// currently lists and the ones that have to be fetched
+type idRefresh struct {
+	dataset string
+	current []int
+	fetch   []int
+	deleted int
+}
+
+// refreshCache rebuilds the datasets that are due in a separate staging
+// database, then swaps it into db in a single transaction together with the
+// build number. A failed refresh leaves db exactly as it was.
+//
+// Datasets that are not due are copied over unchanged, and incremental
+// refreshes copy the known recipes and items so only new IDs are fetched.
+func refreshCache(client *APIClient, db *sqlx.DB, buildMetadata Metadata, merchantDataPath string, options CacheRefreshOptions) error {
+	err := storeDatasetTTLs(db, options.DatasetTTLs)
+	if err != nil {
+		return err
+	}
+	plan, err := planCacheRefresh(db, buildMetadata.BuildNumber, merchantDataPath, options, time.Now())
+	if err != nil {
+		return err
+	}
+	if len(plan.datasets) == 0 {
+		logger.Debug("Local cache is up to date")
+		return nil
+	}
+	var idPlans []idRefresh
+	if plan.datasets["recipes"] {
+		recipeIds, err := client.FetchAllRecipesIds()
+		if err != nil {
+			return fmt.Errorf("Failed to fetch recipe ids from API: %w", err)
+		}
+		recipes, err := planIdRefresh(db, "recipes", recipeIds, plan.refetch["recipes"])
+		if err != nil {
+			return err
+		}
+		idPlans = append(idPlans, recipes)
+	}
+	if plan.datasets["items"] {
+		itemIds, err := client.FetchAllItemsIds()
+		if err != nil {
+			return fmt.Errorf("Failed to fetch item ids from API: %w", err)
+		}
+		items, err := planIdRefresh(db, "items", itemIds, plan.refetch["items"])
+		if err != nil {
+			return err
+		}
+		idPlans = append(idPlans, items)
+	}
+	for _, idPlan := range idPlans {
+		logger.Info("Planned cache refresh", "dataset", idPlan.dataset, "full", plan.refetch[idPlan.dataset], "current", len(idPlan.current), "fetching", len(idPlan.fetch), "deleted", idPlan.deleted)
+	}
+	logger.Info("Refreshing local cache", "datasets", plannedDatasetNames(plan))
+
+	stagingPath, err := stagingDatabasePath(db)
+	if err != nil {
+		return err
+	}
+	// A previous run may have died halfway through
+	if err := removeStagingDatabase(stagingPath); err != nil {
+		return err
+	}
+	defer func() {
+		if err := removeStagingDatabase(stagingPath); err != nil {
+			logger.Warn("Failed to remove staging cache", "path", stagingPath, "error", err)
+		}
+	}()
+
+	staging, err := sqlx.Connect("sqlite3", stagingPath)
+	if err != nil {
+		return fmt.Errorf("Failed to create staging cache: %w", err)
+	}
+	err = migrateCache(staging)
+	if err == nil {
+		err = writeKnownIds(staging, buildMetadata.BuildNumber, idPlans...)
+	}
+	if err == nil {
+		err = seedStagingCache(db, stagingPath, buildMetadata.BuildNumber, plan)
+	}
+	if err == nil {
+		err = populateStagingCache(client, staging, plan, idPlans, merchantDataPath)
+	}
+	if closeErr := staging.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return swapStagingCache(db, stagingPath, buildMetadata, plan)
+}
+
+// plannedDatasetNames lists the datasets of a plan in refresh order
+func plannedDatasetNames(plan cacheRefreshPlan) []string {
+	var names []string
+	for _, dataset := range cacheDatasets {
+		if plan.datasets[dataset.name] {
+			names = append(names, dataset.name)
+		}
+	}
+	return names
+}
+
+// needsFullRefresh reports whether recipes and items have to be refetched in full
+func needsFullRefresh(db *sqlx.DB, options CacheRefreshOptions, now time.Time) (bool, error) {
+	if options.ForceFull {
+		logger.Info("Full cache refresh requested")
+		return true, nil
+	}
+	var lastFullRefresh sql.NullTime
+	err := db.Get(&lastFullRefresh, "SELECT last_full_refresh FROM metadata")
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("Failed to query last full refresh: %w", err)
+	}
+	if !lastFullRefresh.Valid {
+		return true, nil
+	}
+	interval := options.FullRefreshInterval
+	if interval <= 0 {
+		interval = DefaultFullRefreshInterval
+	}
+	if now.Sub(lastFullRefresh.Time) >= interval {
+		logger.Info("Last full cache refresh is too old", "lastFullRefresh", lastFullRefresh.Time, "interval", interval.String())
+		return true, nil
+	}
+	return false, nil
+}
+
+// planIdRefresh compares the current IDs of a dataset with the known ones
+func planIdRefresh(db *sqlx.DB, dataset string, current []int, full bool) (idRefresh, error) {
+	var known []int
+	err := db.Select(&known, "SELECT id FROM known_ids WHERE dataset = ?", dataset)
+	if err != nil {
+		return idRefresh{}, fmt.Errorf("Failed to load known %s ids: %w", dataset, err)
+	}
+	knownSet := make(map[int]bool, len(known))
+	for _, id := range known {
+		knownSet[id] = true
+	}
+	plan := idRefresh{dataset: dataset, current: current}
+	currentSet := make(map[int]bool, len(current))
+	for _, id := range current {
+		currentSet[id] = true
+		if full || !knownSet[id] {
+			plan.fetch = append(plan.fetch, id)
+		}
+	}
+	for _, id := range known {
+		if !currentSet[id] {
+			plan.deleted++
+		}
+	}
+	return plan, nil
+}
+
+// writeKnownIds records the current IDs of each dataset in the staging database
+func writeKnownIds(staging *sqlx.DB, buildNumber int, plans ...idRefresh) error {
+	tx, err := staging.Beginx()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Preparex("INSERT OR IGNORE INTO known_ids (dataset, id, first_build) VALUES (?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, plan := range plans {
+		for _, id := range plan.current {
+			if _, err := stmt.Exec(plan.dataset, id, buildNumber); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("Failed to record known %s id %d: %w", plan.dataset, id, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// seedStagingCache copies the datasets that are not refreshed from db into the
+// staging database, carries the ID history over and, unless they are refetched,
+// copies the recipes and items that are still listed by the API so only new
+// ones have to be fetched
+func seedStagingCache(db *sqlx.DB, stagingPath string, buildNumber int, plan cacheRefreshPlan) error {
+	return withStagingAttached(db, stagingPath, func(tx *sqlx.Tx) error {
+		for _, dataset := range cacheDatasets {
+			if plan.datasets[dataset.name] && !dataset.inPlace {
+				continue
+			}
+			for _, table := range dataset.tables {
+				if err := copyTable(tx, table, "1"); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec("INSERT INTO staging.known_ids SELECT * FROM main.known_ids WHERE dataset = ?", dataset.name)
+			if err != nil {
+				return fmt.Errorf("Failed to copy known %s ids: %w", dataset.name, err)
+			}
+		}
+
+		_, err := tx.Exec(`
+			UPDATE staging.known_ids SET first_build = (
+				SELECT m.first_build FROM main.known_ids m WHERE m.dataset = known_ids.dataset AND m.id = known_ids.id
+			)
+			WHERE EXISTS (SELECT 1 FROM main.known_ids m WHERE m.dataset = known_ids.dataset AND m.id = known_ids.id)
+		`)
+		if err != nil {
+			return fmt.Errorf("Failed to carry over known ids: %w", err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO staging.deleted_ids (dataset, id, build_number) SELECT dataset, id, build_number FROM main.deleted_ids;
+			INSERT OR IGNORE INTO staging.deleted_ids (dataset, id, build_number)
+			SELECT m.dataset, m.id, ? FROM main.known_ids m
+			WHERE NOT EXISTS (SELECT 1 FROM staging.known_ids s WHERE s.dataset = m.dataset AND s.id = m.id);
+		`, buildNumber)
+		if err != nil {
+			return fmt.Errorf("Failed to record deleted ids: %w", err)
+		}
+		stillListed := map[string]string{
+			"recipes":           "id IN (SELECT id FROM staging.known_ids WHERE dataset = 'recipes')",
+			"ingredients":       "recipe_id IN (SELECT id FROM staging.known_ids WHERE dataset = 'recipes')",
+			"guild_ingredients": "recipe_id IN (SELECT id FROM staging.known_ids WHERE dataset = 'recipes')",
+			"items":             "id IN (SELECT id FROM staging.known_ids WHERE dataset = 'items')",
+		}
+		for _, dataset := range cacheDatasets {
+			if dataset.name != "recipes" && dataset.name != "items" || !plan.datasets[dataset.name] || plan.refetch[dataset.name] {
+				continue
+			}
+			for _, table := range dataset.tables {
+				if err := copyTable(tx, table, stillListed[table]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// copyTable copies the rows of a table matching condition from db into the
+// staging database
+func copyTable(tx *sqlx.Tx, table string, condition string) error {
+	columnList, err := tableColumnList(tx, table)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("INSERT INTO staging.%s (%s) SELECT %s FROM main.%s WHERE %s", table, columnList, columnList, table, condition))
+	if err != nil {
+		return fmt.Errorf("Failed to copy %s: %w", table, err)
+	}
+	return nil
+}
+
+// populateStagingCache fetches the planned datasets into the staging database
+func populateStagingCache(client *APIClient, staging *sqlx.DB, plan cacheRefreshPlan, idPlans []idRefresh, merchantDataPath string) error {
+	for _, idPlan := range idPlans {
+		switch idPlan.dataset {
+		case "recipes":
+			if err := refreshRecipeCache(client, staging, idPlan.fetch); err != nil {
+				return fmt.Errorf("Failure updating local recipe cache: %w", err)
+			}
+		case "items":
+			if err := refreshItemCache(client, staging, idPlan.fetch); err != nil {
+				return fmt.Errorf("Failure updating local item cache: %w", err)
+			}
+		}
+	}
+	if plan.datasets["tradeable"] {
+		tradeableItemIds, err := client.FetchAllIds("/commerce/prices")
+		if err != nil {
+			return fmt.Errorf("Failed to fetch tradeable item ids from API: %w", err)
+		}
+		err = updateTradeableItemsCache(staging, tradeableItemIds)
+		if err != nil {
+			return fmt.Errorf("Failure updating local tradeable item cache: %w", err)
+		}
+	}
+	if plan.datasets["currencies"] {
+		currencies, err := client.FetchCurrencies()
+		if err != nil {
+			return fmt.Errorf("Failed to fetch currency info from API: %w", err)
+		}
+		err = updateCurrencyCache(staging, currencies)
+		if err != nil {
+			return fmt.Errorf("Failure updating local currency info cache: %w", err)
+		}
+	}
+	if plan.datasets["guild_upgrades"] {
+		guildUpgrades, err := client.FetchAllGuildUpgrades()
+		if err != nil {
+			return fmt.Errorf("Failed to fetch guild upgrades from API: %w", err)
+		}
+		err = updateGuildUpgradeCache(staging, guildUpgrades)
+		if err != nil {
+			return fmt.Errorf("Failure updating local guild upgrade cache: %w", err)
+		}
+	}
+	if plan.datasets["material_categories"] {
+		materialCategories, err := client.FetchMaterialCategories()
+		if err != nil {
+			return fmt.Errorf("Failed to fetch material categories from API: %w", err)
+		}
+		err = updateMaterialCategoryCache(staging, materialCategories)
+		if err != nil {
+			return fmt.Errorf("Failure updating local material category cache: %w", err)
+		}
+	}
+	// Matched against the staged items and recipes, so it must come after them
+	if plan.datasets["daily_crafting"] {
+		dailyCrafting, err := client.FetchDailyCrafting()
+		if err != nil {
+			return fmt.Errorf("Failed to fetch daily crafting info from API: %w", err)
+		}
+		err = updateDailyCraftingCache(staging, dailyCrafting)
+		if err != nil {
+			return fmt.Errorf("Failure updating local daily crafting cache: %w", err)
+		}
+	}
+	if plan.datasets["merchants"] {
+		merchants, err := ParseMerchantDataFile(merchantDataPath)
+		if err != nil {
+			return fmt.Errorf("Failure loading Merchant data from JSON file: %w", err)
+		}
+		report, err := importMerchantData(staging, merchants)
+		if err != nil {
+			return fmt.Errorf("Failed to update local merchant cache: %w", err)
+		}
+		logger.Info("Imported merchant data", "changed", report.Changed(),
+			"merchantsAdded", report.MerchantsAdded, "merchantsUpdated", report.MerchantsUpdated, "merchantsRemoved", report.MerchantsRemoved,
+			"offeringsAdded", report.OfferingsAdded, "offeringsUpdated", report.OfferingsUpdated, "offeringsRemoved", report.OfferingsRemoved,
+			"duplicates", report.Duplicates)
+	}
+	return nil
+}
+
+// swapStagingCache replaces the staged tables of db with the staging database
+// contents and records the new build and dataset refreshes, all in one
+// transaction
+func swapStagingCache(db *sqlx.DB, stagingPath string, buildMetadata Metadata, plan cacheRefreshPlan) error {
+	return withStagingAttached(db, stagingPath, func(tx *sqlx.Tx) error {
+		for _, table := range stagedTables {
+			columnList, err := tableColumnList(tx, table)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM main.%s", table))
+			if err != nil {
+				return fmt.Errorf("Failed to clear %s: %w", table, err)
+			}
+			_, err = tx.Exec(fmt.Sprintf("INSERT INTO main.%s (%s) SELECT %s FROM staging.%s", table, columnList, columnList, table))
+			if err != nil {
+				return fmt.Errorf("Failed to copy staged %s: %w", table, err)
+			}
+		}
+		now := time.Now().UTC()
+		if plan.newBuild {
+			err := updateBuildMetadata(tx, buildMetadata)
+			if err != nil {
+				return fmt.Errorf("Could not update Build metadata: %w", err)
+			}
+		}
+		if plan.full {
+			_, err := tx.Exec("UPDATE metadata SET last_full_refresh = ?", now)
+			if err != nil {
+				return fmt.Errorf("Could not record full refresh: %w", err)
+			}
+		}
+		if err := recordDatasetRefreshes(tx, plan, now); err != nil {
+			return err
+		}
+		// After recording the refresh, which the index rebuild is marked with
+		if plan.datasets["items"] {
+			return rebuildItemSearchIndex(tx)
+		}
+		return nil
+	})
+}
+
+// withStagingAttached runs fn in a transaction on a connection to db with the
+// staging database attached as "staging"
+func withStagingAttached(db *sqlx.DB, stagingPath string, fn func(tx *sqlx.Tx) error) error {
+	ctx := context.Background()
+	// ATTACH is per connection, so everything has to stay on a single one
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS staging", stagingPath)
+	if err != nil {
+		return fmt.Errorf("Failed to attach staging cache: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "DETACH DATABASE staging"); err != nil {
+			logger.Warn("Failed to detach staging cache", "error", err)
+		}
+	}()
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to commit staging cache changes: %w", err)
+	}
+	return nil
+}
+
+// tableColumnList returns the quoted columns of a table in the main database
+func tableColumnList(tx *sqlx.Tx, table string) (string, error) {
+	var columns []string
+	err := tx.Select(&columns, "SELECT name FROM pragma_table_info(?, 'main')", table)
+	if err != nil {
+		return "", err
+	}
+	return quoteIdentifiers(columns), nil
+}
+
+// stagingDatabasePath places the staging database next to the cache file, or
+// in the temporary directory for in-memory caches
+func stagingDatabasePath(db *sqlx.DB) (string, error) {
+	var file string
+	err := db.Get(&file, "SELECT file FROM pragma_database_list WHERE name = 'main'")
+	if err != nil {
+		return "", fmt.Errorf("Failed to locate cache database: %w", err)
+	}
+	if file != "" {
+		return file + ".staging", nil
+	}
+	stagingFile, err := os.CreateTemp("", "gw2-mastercrafter-staging-*.db")
+	if err != nil {
+		return "", err
+	}
+	stagingFile.Close()
+	return stagingFile.Name(), nil
+}
+
+func removeStagingDatabase(path string) error {
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = `"` + name + `"`
+	}
+	return strings.Join(quoted, ", ")
+}
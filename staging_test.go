@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deadpyxel/gw2-mastercrafter/internal/fakeapi"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestRefreshCache(t *testing.T) {
+	fake := fakeapi.New()
+	err := fake.AddItems(Item{ID: 10, Name: "Lump of Mithrillium", Type: "CraftingMaterial"}, Item{ID: 20, Name: "Mithril Ore", Type: "CraftingMaterial"})
+	if err != nil {
+		t.Fatalf("Failed to seed items: %v", err)
+	}
+	err = fake.AddRecipes(Recipe{ID: 1, Type: "Refinement", OutputItemID: 10, OutputItemCount: 1, Disciplines: StringSlice{"Huntsman"}, Ingredients: []Ingredient{{ItemID: 20, Count: 50}}})
+	if err != nil {
+		t.Fatalf("Failed to seed recipes: %v", err)
+	}
+	if err := fake.AddPrices(ItemPrice{ID: 20}); err != nil {
+		t.Fatalf("Failed to seed prices: %v", err)
+	}
+	if err := fake.AddCurrencies(Currency{ID: 1, Name: "Coin"}); err != nil {
+		t.Fatalf("Failed to seed currencies: %v", err)
+	}
+	fake.SetDailyCrafting("lump_of_mithrillium")
+
+	failDailyCrafting := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failDailyCrafting && r.URL.Path == "/dailycrafting" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := NewAPIClient(server.URL, "token")
+
+	dir := t.TempDir()
+	merchantDataPath := filepath.Join(dir, "merchant-data.json")
+	err = os.WriteFile(merchantDataPath, []byte(`[{"name": "Miyani", "locations": ["Lion's Arch"], "purchase_options": [
+		{"type": "Item", "id": 20, "count": 1, "price": [{"type": "Currency", "id": 1, "count": 50}]}]}]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachePath := filepath.Join(dir, "cache.db")
+	db, err := sqlx.Connect("sqlite3", cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrateCache(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data from the previous build, plus account history that must survive refreshes
+	if err := updateItemCache(db, []Item{{ID: 999, Name: "Removed Item"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateBuildMetadata(db, Metadata{BuildNumber: 100}); err != nil {
+		t.Fatal(err)
+	}
+	transaction := Transaction{ID: 5, ItemID: 20, Price: 10, Quantity: 1, Created: time.Now(), Purchased: time.Now()}
+	if err := updateTransactionCache(db, TransactionSideBuys, []Transaction{transaction}); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(query string) int {
+		t.Helper()
+		var n int
+		if err := db.Get(&n, query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return n
+	}
+
+	// A failure halfway through keeps the previous build intact
+	failDailyCrafting = true
+	if err := refreshCache(client, db, Metadata{BuildNumber: 200}, merchantDataPath, CacheRefreshOptions{}); err == nil {
+		t.Fatal("refreshCache() succeeded although /dailycrafting failed")
+	}
+	if buildNumber, _ := fetchStoredBuildNumber(db); buildNumber != 100 {
+		t.Errorf("Build number after failed refresh = %d, want 100", buildNumber)
+	}
+	if n := count("SELECT COUNT(*) FROM items WHERE id = 999"); n != 1 {
+		t.Error("Failed refresh removed the previous items")
+	}
+	if n := count("SELECT COUNT(*) FROM recipes"); n != 0 {
+		t.Errorf("Failed refresh left %d recipes behind", n)
+	}
+	if _, err := os.Stat(cachePath + ".staging"); !os.IsNotExist(err) {
+		t.Errorf("Staging cache left behind after failed refresh: %v", err)
+	}
+
+	failDailyCrafting = false
+	if err := refreshCache(client, db, Metadata{BuildNumber: 200}, merchantDataPath, CacheRefreshOptions{}); err != nil {
+		t.Fatalf("refreshCache() returned error: %v", err)
+	}
+	if buildNumber, _ := fetchStoredBuildNumber(db); buildNumber != 200 {
+		t.Errorf("Build number after refresh = %d, want 200", buildNumber)
+	}
+	checks := []struct {
+		query string
+		want  int
+	}{
+		{"SELECT COUNT(*) FROM items", 2},
+		{"SELECT COUNT(*) FROM items WHERE id = 999", 0},
+		{"SELECT COUNT(*) FROM recipes", 1},
+		{"SELECT COUNT(*) FROM ingredients", 1},
+		{"SELECT COUNT(*) FROM tradeable_items", 1},
+		{"SELECT COUNT(*) FROM currencies", 1},
+		{"SELECT COUNT(*) FROM daily_crafting WHERE recipe_id = 1", 1},
+		{"SELECT COUNT(*) FROM merchant_prices", 1},
+		{"SELECT COUNT(*) FROM transactions", 1},
+	}
+	for _, check := range checks {
+		if got := count(check.query); got != check.want {
+			t.Errorf("%s = %d, want %d", check.query, got, check.want)
+		}
+	}
+	if _, err := os.Stat(cachePath + ".staging"); !os.IsNotExist(err) {
+		t.Errorf("Staging cache left behind after refresh: %v", err)
+	}
+
+	// Refreshing again replaces merchant offerings instead of duplicating them
+	if err := refreshCache(client, db, Metadata{BuildNumber: 201}, merchantDataPath, CacheRefreshOptions{}); err != nil {
+		t.Fatalf("Second refreshCache() returned error: %v", err)
+	}
+	if got := count("SELECT COUNT(*) FROM merchant_prices"); got != 1 {
+		t.Errorf("merchant_prices has %d rows after a second refresh, want 1", got)
+	}
+}
+
+func TestIncrementalRefreshCache(t *testing.T) {
+	newFake := func(items ...Item) *fakeapi.Server {
+		fake := fakeapi.New()
+		for _, item := range items {
+			if err := fake.AddItems(item); err != nil {
+				t.Fatalf("Failed to seed items: %v", err)
+			}
+		}
+		err := fake.AddRecipes(Recipe{ID: 1, Type: "Refinement", OutputItemID: 10, OutputItemCount: 1, Ingredients: []Ingredient{{ItemID: 20, Count: 2}}})
+		if err != nil {
+			t.Fatalf("Failed to seed recipes: %v", err)
+		}
+		return fake
+	}
+	active := newFake(Item{ID: 10, Name: "Plank"}, Item{ID: 20, Name: "Log"})
+	var fetchedItems []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/items" && r.URL.Query().Has("ids") {
+			fetchedItems = append(fetchedItems, r.URL.Query().Get("ids"))
+		}
+		active.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := NewAPIClient(server.URL, "token")
+
+	merchantDataPath := filepath.Join(t.TempDir(), "merchant-data.json")
+	if err := os.WriteFile(merchantDataPath, []byte(`[]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	itemName := func(itemID int) string {
+		t.Helper()
+		var name string
+		if err := db.Get(&name, "SELECT name FROM items WHERE id = ?", itemID); err != nil {
+			return ""
+		}
+		return name
+	}
+
+	// The first refresh has nothing to build on, so it fetches everything
+	if err := refreshCache(client, db, Metadata{BuildNumber: 100}, merchantDataPath, CacheRefreshOptions{}); err != nil {
+		t.Fatalf("refreshCache() returned error: %v", err)
+	}
+	if !reflect.DeepEqual(fetchedItems, []string{"10,20"}) {
+		t.Errorf("First refresh fetched items %v, want [10,20]", fetchedItems)
+	}
+
+	// Item 20 is removed, item 30 is added and item 10 changes
+	active = newFake(Item{ID: 10, Name: "Renamed Plank"}, Item{ID: 30, Name: "Board"})
+	fetchedItems = nil
+	if err := refreshCache(client, db, Metadata{BuildNumber: 101}, merchantDataPath, CacheRefreshOptions{}); err != nil {
+		t.Fatalf("Incremental refreshCache() returned error: %v", err)
+	}
+	if !reflect.DeepEqual(fetchedItems, []string{"30"}) {
+		t.Errorf("Incremental refresh fetched items %v, want only the new item [30]", fetchedItems)
+	}
+	if name := itemName(10); name != "Plank" {
+		t.Errorf("Known item 10 is %q, want it kept as \"Plank\" until the next full refresh", name)
+	}
+	if name := itemName(20); name != "" {
+		t.Errorf("Removed item 20 is still cached as %q", name)
+	}
+	if name := itemName(30); name != "Board" {
+		t.Errorf("New item 30 is %q, want \"Board\"", name)
+	}
+	var deleted []int
+	if err := db.Select(&deleted, "SELECT id FROM deleted_ids WHERE dataset = 'items' AND build_number = 101"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, []int{20}) {
+		t.Errorf("Deleted items = %v, want [20]", deleted)
+	}
+	var firstBuild int
+	if err := db.Get(&firstBuild, "SELECT first_build FROM known_ids WHERE dataset = 'items' AND id = 10"); err != nil || firstBuild != 100 {
+		t.Errorf("Item 10 first build = %d (%v), want 100", firstBuild, err)
+	}
+
+	// Forcing a full refresh picks up the changed item
+	fetchedItems = nil
+	if err := refreshCache(client, db, Metadata{BuildNumber: 102}, merchantDataPath, CacheRefreshOptions{ForceFull: true}); err != nil {
+		t.Fatalf("Full refreshCache() returned error: %v", err)
+	}
+	if !reflect.DeepEqual(fetchedItems, []string{"10,30"}) {
+		t.Errorf("Full refresh fetched items %v, want [10,30]", fetchedItems)
+	}
+	if name := itemName(10); name != "Renamed Plank" {
+		t.Errorf("Item 10 after full refresh is %q, want \"Renamed Plank\"", name)
+	}
+}
+
+func TestNeedsFullRefresh(t *testing.T) {
+	db, cleanup := setupDB(t)
+	defer cleanup()
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	full, err := needsFullRefresh(db, CacheRefreshOptions{}, now)
+	if err != nil || !full {
+		t.Errorf("needsFullRefresh() without a previous full refresh = %v, %v, want true", full, err)
+	}
+
+	if _, err := db.Exec("UPDATE metadata SET last_full_refresh = ?", now.Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		options CacheRefreshOptions
+		want    bool
+	}{
+		{"Recent full refresh within the default interval", CacheRefreshOptions{}, false},
+		{"Forced", CacheRefreshOptions{ForceFull: true}, true},
+		{"Older than the configured interval", CacheRefreshOptions{FullRefreshInterval: 24 * time.Hour}, true},
+		{"Within the configured interval", CacheRefreshOptions{FullRefreshInterval: 72 * time.Hour}, false},
+	}
+	for _, tt := range tests {
+		full, err := needsFullRefresh(db, tt.options, now)
+		if err != nil || full != tt.want {
+			t.Errorf("%s: needsFullRefresh() = %v, %v, want %v", tt.name, full, err, tt.want)
+		}
+	}
+}
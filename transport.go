@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// A Middleware wraps a RoundTripper, e.g. to add headers or trace requests
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// newDefaultTransport returns a keep-alive transport sized for the client's
+// concurrent batch fetches. It negotiates gzip transparently, and requests go
+// through proxyURL when set, or through the proxy from the environment otherwise.
+func newDefaultTransport(proxyURL *url.URL) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 32
+	transport.MaxIdleConnsPerHost = 16
+	transport.IdleConnTimeout = 90 * time.Second
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport
+}
+
+// chainMiddleware wraps transport so the first middleware sees requests first
+func chainMiddleware(transport http.RoundTripper, middleware []Middleware) http.RoundTripper {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		transport = middleware[i](transport)
+	}
+	return transport
+}
+
+// UserAgentMiddleware sets the User-Agent header on every request
+func UserAgentMiddleware(userAgent string) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Header.Set("User-Agent", userAgent)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// TracingMiddleware logs every request with its outcome and duration at debug level
+func TracingMiddleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			response, err := next.RoundTrip(req)
+			// Only the path is logged, query strings can be long ID lists
+			if err != nil {
+				logger.Debug("HTTP request failed", "method", req.Method, "host", req.URL.Host, "path", req.URL.Path, "duration", time.Since(start).String(), "error", err)
+				return nil, err
+			}
+			logger.Debug("HTTP request", "method", req.Method, "host", req.URL.Host, "path", req.URL.Path, "status", response.StatusCode, "duration", time.Since(start).String())
+			return response, nil
+		})
+	}
+}
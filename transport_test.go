@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestAPIClientMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var userAgents []string
+	newConnections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		w.Write([]byte(`[1, 2]`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			newConnections++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	client := NewAPIClient(server.URL, "token",
+		WithMiddleware(tag("outer"), UserAgentMiddleware("mastercrafter-test")),
+		WithMiddleware(tag("inner")),
+	)
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.FetchAllIds("/items"); err != nil {
+			t.Fatalf("FetchAllIds() returned error: %v", err)
+		}
+	}
+
+	if want := []string{"outer", "inner", "outer", "inner", "outer", "inner"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("Middleware order = %v, want %v", order, want)
+	}
+	if want := []string{"mastercrafter-test", "mastercrafter-test", "mastercrafter-test"}; !reflect.DeepEqual(userAgents, want) {
+		t.Errorf("User agents = %v, want %v", userAgents, want)
+	}
+	// Sequential requests reuse the pooled keep-alive connection
+	if newConnections != 1 {
+		t.Errorf("Client opened %d connections, want 1", newConnections)
+	}
+}
+
+func TestAPIClientMiddlewareWrapsCustomTransport(t *testing.T) {
+	var reached []string
+	base := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		reached = append(reached, req.Header.Get("User-Agent"))
+		recorder := httptest.NewRecorder()
+		recorder.Write([]byte(`[]`))
+		return recorder.Result(), nil
+	})
+	client := NewAPIClient("http://gw2.invalid/v2", "token", WithTransport(base), WithMiddleware(UserAgentMiddleware("custom")))
+	if _, err := client.FetchAllIds("/items"); err != nil {
+		t.Fatalf("FetchAllIds() returned error: %v", err)
+	}
+	if !reflect.DeepEqual(reached, []string{"custom"}) {
+		t.Errorf("Custom transport saw user agents %v, want [custom]", reached)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type Metadata struct {
@@ -16,15 +18,25 @@ type Ingredient struct {
 	RecipeID int `db:"recipe_id"`
 }
 
+// A GuildIngredient is a guild upgrade (e.g. a decoration) consumed by a recipe
+type GuildIngredient struct {
+	ID        int `db:"id"`
+	UpgradeID int `json:"upgrade_id" db:"upgrade_id"`
+	Count     int `json:"count" db:"count"`
+	RecipeID  int `db:"recipe_id"`
+}
+
 type Recipe struct {
-	ID              int          `json:"id" db:"id"`
-	Type            string       `json:"type" db:"type"`
-	OutputItemID    int          `json:"output_item_id" db:"output_item_id"`
-	OutputItemCount int          `json:"output_item_count" db:"output_item_count"`
-	Disciplines     StringSlice  `json:"disciplines" db:"disciplines"` // TODO: Define a StringSlice type?
-	MinRating       int          `json:"min_rating" db:"min_rating"`
-	Flags           StringSlice  `json:"flags" db:"flags"`
-	Ingredients     []Ingredient `json:"ingredients"`
+	ID               int               `json:"id" db:"id"`
+	Type             string            `json:"type" db:"type"`
+	OutputItemID     int               `json:"output_item_id" db:"output_item_id"`
+	OutputItemCount  int               `json:"output_item_count" db:"output_item_count"`
+	Disciplines      StringSlice       `json:"disciplines" db:"disciplines"` // TODO: Define a StringSlice type?
+	MinRating        int               `json:"min_rating" db:"min_rating"`
+	Flags            StringSlice       `json:"flags" db:"flags"`
+	Ingredients      []Ingredient      `json:"ingredients"`
+	OutputUpgradeID  int               `json:"output_upgrade_id" db:"output_upgrade_id"` // Guild upgrade produced by guild recipes
+	GuildIngredients []GuildIngredient `json:"guild_ingredients"`
 }
 
 type Currency struct {
@@ -62,15 +74,92 @@ func (tpPrice TradingPostPrice) String() string {
 	return fmt.Sprintf("Price: %s, Orders: %d", priceString, tpPrice.Quantity)
 }
 
+// An ExchangeRate is a quote from the gem exchange. Quantity is the amount
+// received in the target currency for the requested input.
+type ExchangeRate struct {
+	CoinsPerGem int `json:"coins_per_gem"`
+	Quantity    int `json:"quantity"`
+}
+
 type RecipeIds []int
 
 type Item struct {
-	Name        string      `json:"name" db:"name"`
-	Type        string      `json:"type" db:"type"`
-	Rarity      string      `json:"rarity" db:"rarity"`
-	VendorValue int         `json:"vendor_value" db:"vendor_value"`
-	Flags       StringSlice `json:"flags" db:"flags"`
-	ID          int         `json:"id" db:"id"`
+	Name         string       `json:"name" db:"name"`
+	Type         string       `json:"type" db:"type"`
+	Rarity       string       `json:"rarity" db:"rarity"`
+	VendorValue  int          `json:"vendor_value" db:"vendor_value"`
+	Flags        StringSlice  `json:"flags" db:"flags"`
+	ID           int          `json:"id" db:"id"`
+	Level        int          `json:"level" db:"level"`
+	Description  string       `json:"description" db:"description"`
+	ChatLink     string       `json:"chat_link" db:"chat_link"`
+	Restrictions StringSlice  `json:"restrictions" db:"restrictions"`
+	Details      ItemDetails  `json:"details" db:"details"`
+	UpgradesInto ItemUpgrades `json:"upgrades_into" db:"upgrades_into"`
+	UpgradesFrom ItemUpgrades `json:"upgrades_from" db:"upgrades_from"`
+}
+
+// ItemDetails holds the type specific details of an item. Only the commonly
+// filtered fields are decoded, the full object is kept for storage.
+type ItemDetails struct {
+	Type        string `json:"type,omitempty"`         // Item subtype, e.g. "Coat" for armor
+	WeightClass string `json:"weight_class,omitempty"` // Armor weight: Heavy, Medium, Light or Clothing
+	StatChoices []int  `json:"stat_choices,omitempty"` // Selectable itemstat IDs
+	raw         json.RawMessage
+}
+
+func (d *ItemDetails) UnmarshalJSON(data []byte) error {
+	type plainDetails ItemDetails
+	var details plainDetails
+	if err := json.Unmarshal(data, &details); err != nil {
+		return err
+	}
+	*d = ItemDetails(details)
+	d.raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (d ItemDetails) MarshalJSON() ([]byte, error) {
+	if d.raw != nil {
+		return d.raw, nil
+	}
+	type plainDetails ItemDetails
+	return json.Marshal(plainDetails(d))
+}
+
+func (d *ItemDetails) Scan(value interface{}) error {
+	return scanJSON(value, d)
+}
+
+// An ItemUpgrade links an item to what it upgrades into or from, e.g. through the Mystic Forge
+type ItemUpgrade struct {
+	Upgrade string `json:"upgrade"`
+	ItemID  int    `json:"item_id"`
+}
+
+type ItemUpgrades []ItemUpgrade
+
+func (u *ItemUpgrades) Scan(value interface{}) error {
+	return scanJSON(value, u)
+}
+
+// scanJSON decodes a JSON text column, leaving the target untouched for NULL or empty values
+func scanJSON(value interface{}, target interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("unexpected type for JSON column: %T", value)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, target)
 }
 
 type StringSlice []string
@@ -85,13 +174,138 @@ func (s *StringSlice) Scan(value interface{}) error {
 	if !ok {
 		return fmt.Errorf("unexpected type for StringSlice: %T", value)
 	}
+	// An empty slice is stored as "", which is not a single empty string
+	if str == "" {
+		*s = nil
+		return nil
+	}
 
 	*s = strings.Split(str, ",")
 	return nil
 }
 
 type RecipeProfit struct {
-	RecipeID     int
-	OutputItemID int
-	ProfitMargin float64
+	RecipeID          int
+	OutputItemID      int
+	ProfitMargin      float64
+	DailyLimited      bool // Recipe can only be crafted once per day per account
+	DailyCraftUsed    bool // Today's craft of a daily limited recipe was already used
+	DailyCraftUnknown bool // The account's daily crafting could not be fetched, so DailyCraftUsed is a guess
+	MaxCrafts         int  // Crafts still possible today, -1 when unlimited
+}
+
+type CraftingDiscipline struct {
+	Discipline string `json:"discipline"`
+	Rating     int    `json:"rating"`
+	Active     bool   `json:"active"`
+}
+
+type Character struct {
+	Name     string               `json:"name"`
+	Crafting []CraftingDiscipline `json:"crafting"`
+}
+
+// A MaterialStack is an item stored in the account's material storage
+type MaterialStack struct {
+	ItemID   int `json:"id"`
+	Category int `json:"category"`
+	Count    int `json:"count"`
+}
+
+// A GuildUpgradeCost is one of the costs to build a guild upgrade. Type is
+// "Item", "Collectible", "Currency" or "Coins"; ItemID is set for items.
+type GuildUpgradeCost struct {
+	Type   string `json:"type" db:"type"`
+	Name   string `json:"name" db:"name"`
+	Count  int    `json:"count" db:"count"`
+	ItemID int    `json:"item_id" db:"item_id"`
+}
+
+type GuildUpgrade struct {
+	ID            int                `json:"id" db:"id"`
+	Name          string             `json:"name" db:"name"`
+	Description   string             `json:"description" db:"description"`
+	Type          string             `json:"type" db:"type"` // e.g. "Decoration", "Consumable", "Unlock"
+	RequiredLevel int                `json:"required_level" db:"required_level"`
+	Costs         []GuildUpgradeCost `json:"costs"`
+}
+
+// A GuildRecipeCost is the coin value of the tradable inputs of a guild recipe,
+// including those of the decorations it consumes
+type GuildRecipeCost struct {
+	RecipeID              int
+	OutputUpgradeID       int
+	Cost                  int
+	UntradableIngredients []int // Item IDs that could not be valued and are excluded from Cost
+	UncraftableUpgrades   []int // Guild upgrade IDs without a recipe, excluded from Cost
+}
+
+// A MaterialCategory is a material storage tab, e.g. "Cooking Ingredients"
+type MaterialCategory struct {
+	ID    int    `json:"id" db:"id"`
+	Name  string `json:"name" db:"name"`
+	Items []int  `json:"items"`
+	Order int    `json:"order" db:"sort_order"`
+}
+
+// An AccountRecipeProfit is a profitable recipe along with the accounts able to
+// craft it. The recommended account can cover the most crafts from material storage.
+type AccountRecipeProfit struct {
+	RecipeProfit
+	Accounts           []string
+	RecommendedAccount string
+	CraftsFromStorage  int
+}
+
+type TransactionSide string
+
+const (
+	TransactionSideBuys  TransactionSide = "buys"
+	TransactionSideSells TransactionSide = "sells"
+)
+
+// A Transaction is a single Trading Post order, either still listed (current)
+// or already fulfilled (history)
+type Transaction struct {
+	ID        int             `json:"id" db:"id"`
+	ItemID    int             `json:"item_id" db:"item_id"`
+	Price     int             `json:"price" db:"price"`
+	Quantity  int             `json:"quantity" db:"quantity"`
+	Created   time.Time       `json:"created" db:"created"`
+	Purchased time.Time       `json:"purchased" db:"purchased"`
+	Side      TransactionSide `db:"side"`
+}
+
+// A PriceSnapshot is the Trading Post price of an item at one point in time
+type PriceSnapshot struct {
+	ItemID       int       `db:"item_id"`
+	RecordedAt   time.Time `db:"recorded_at"`
+	BuyPrice     int       `db:"buy_price"`
+	BuyQuantity  int       `db:"buy_quantity"`
+	SellPrice    int       `db:"sell_price"`
+	SellQuantity int       `db:"sell_quantity"`
+}
+
+// PriceStats summarizes the price history of an item over a time window
+type PriceStats struct {
+	ItemID      int     `db:"item_id"`
+	Snapshots   int     `db:"snapshots"`
+	MinBuy      int     `db:"min_buy"`
+	MaxBuy      int     `db:"max_buy"`
+	AverageBuy  float64 `db:"average_buy"`
+	MinSell     int     `db:"min_sell"`
+	MaxSell     int     `db:"max_sell"`
+	AverageSell float64 `db:"average_sell"`
+}
+
+// RealizedProfit is what a recipe actually earned on the Trading Post over a
+// time window, comparable with the ProfitMargin predicted in RecipeProfit
+type RealizedProfit struct {
+	RecipeID       int
+	OutputItemID   int
+	UnitsSold      int
+	Revenue        int // Sale value after Trading Post fees
+	IngredientCost int // Cost of the ingredients for the units sold
+	Profit         int
+	ProfitMargin   float64
 }